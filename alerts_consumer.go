@@ -4,13 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	datadog "github.com/DataDog/datadog-api-client-go/api/v2/datadog"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
-	"github.com/eapache/go-resiliency/retrier"
 	"golang.org/x/net/context"
 
 	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
@@ -28,9 +28,32 @@ const cloudwatchNamespace = "LogMetrics"
 // AlertsConsumer sends datapoints to DataDog
 // It implements the kbc.Sender interface
 type AlertsConsumer struct {
-	dd        DDMetricsAPI
 	deployEnv string
 	cwAPIs    map[string]cloudwatchiface.CloudWatchAPI
+	// ddDestinations are the Datadog organizations by name, including the default one
+	ddDestinations map[string]*ddClient
+	// teamDestinations maps a team to the name of the Datadog destination for its metrics
+	teamDestinations map[string]string
+	// cwBreakers are the circuit breakers of the CloudWatch regions
+	cwBreakers map[string]*sinkBreaker
+	// logLevels are the levels whose logs are counted per app. Empty unless log level metrics are enabled.
+	logLevels []string
+	// pii scrubs PII from dimension values. It may be nil.
+	pii *piiScrubber
+	// quotas tracks log volume against the configured quotas. It may be nil.
+	quotas *quotaTracker
+	// series maps route series to the metric names emitted. It may be nil.
+	series *seriesMapper
+	// limits samples and rate limits routes. It may be nil.
+	limits *routeLimiter
+	// dimensionPolicies restrict the dimensions of routes. It may be nil.
+	dimensionPolicies *dimensionPolicies
+	// coercion converts values that aren't numbers. It may be nil.
+	coercion *valueCoercer
+	// multiValue finds the values and timestamps of routes with several points. It may be nil.
+	multiValue *multiValueRoutes
+	// routePoints bounds the points a route emits from one log. Zero means the default.
+	routePoints routePointsConfig
 }
 
 // DDMetricsAPI is the subset of the Datadog Metrics API that we use
@@ -39,11 +62,107 @@ type DDMetricsAPI interface {
 }
 
 func NewAlertsConsumer(dd DDMetricsAPI, deployEnv string, cwAPIs map[string]cloudwatchiface.CloudWatchAPI) *AlertsConsumer {
-	return &AlertsConsumer{
-		dd:        dd,
+	c := &AlertsConsumer{
 		deployEnv: deployEnv,
 		cwAPIs:    cwAPIs,
 	}
+	c.addDDDestination(newDefaultDDClient(dd), nil)
+	return c
+}
+
+// addDDDestination sends the metrics of teams to the Datadog organization of dest rather than the
+// default one. A dest named defaultDDDestination replaces the default organization.
+func (c *AlertsConsumer) addDDDestination(dest *ddClient, teams []string) {
+	if c.ddDestinations == nil {
+		c.ddDestinations = map[string]*ddClient{}
+	}
+	if c.teamDestinations == nil {
+		c.teamDestinations = map[string]string{}
+	}
+	c.ddDestinations[dest.name] = dest
+	for _, team := range teams {
+		c.teamDestinations[team] = dest.name
+	}
+}
+
+// enableCircuitBreakers puts a circuit breaker in front of every sink. It must be called after
+// all Datadog destinations have been added.
+func (c *AlertsConsumer) enableCircuitBreakers(config breakerConfig) {
+	for name, dest := range c.ddDestinations {
+		dest.breaker = newSinkBreaker("datadog-"+name, config)
+	}
+	c.cwBreakers = map[string]*sinkBreaker{}
+	for region := range c.cwAPIs {
+		c.cwBreakers[region] = newSinkBreaker("cloudwatch-"+region, config)
+	}
+}
+
+// enableLogLevelMetrics counts every app's logs at the configured levels
+func (c *AlertsConsumer) enableLogLevelMetrics(config logLevelConfig) {
+	c.logLevels = config.withDefaults().Levels
+}
+
+// enableLogQuotas tracks the volume logged by teams and apps against quotas
+func (c *AlertsConsumer) enableLogQuotas(configs []quotaConfig) {
+	c.quotas = newQuotaTracker(configs)
+}
+
+// enablePIIScrubbing rejects, redacts or hashes dimension values that look like PII
+func (c *AlertsConsumer) enablePIIScrubbing(config piiConfig, hashKey string) {
+	c.pii = newPIIScrubber(config, hashKey)
+}
+
+// enableSeriesMapping sets the prefixes of metric names, and renames and denies series
+func (c *AlertsConsumer) enableSeriesMapping(config seriesConfig) {
+	c.series = newSeriesMapper(config)
+}
+
+// enableRouteLimits samples and rate limits the points of routes
+func (c *AlertsConsumer) enableRouteLimits(configs []routeLimitConfig) {
+	c.limits = newRouteLimiter(configs)
+}
+
+// enableDimensionPolicies strips the dimensions of routes that violate a policy, or rejects the
+// routes when the policy is strict
+func (c *AlertsConsumer) enableDimensionPolicies(configs []dimensionPolicyConfig) {
+	c.dimensionPolicies = newDimensionPolicies(configs)
+}
+
+// enableValueCoercion converts the values of routes from strings, durations and bools
+func (c *AlertsConsumer) enableValueCoercion(configs []valueCoercionConfig) {
+	c.coercion = newValueCoercer(configs)
+}
+
+// enableMultiValueRoutes emits several values of the logs of routes, with their own timestamps
+func (c *AlertsConsumer) enableMultiValueRoutes(configs []multiValueConfig) {
+	c.multiValue = newMultiValueRoutes(configs)
+}
+
+// limitRoutePoints sets the most points a route emits from one log
+func (c *AlertsConsumer) limitRoutePoints(config routePointsConfig) {
+	c.routePoints = config.withDefaults()
+}
+
+// maxRoutePoints is the most points a route emits from one log
+func (c *AlertsConsumer) maxRoutePoints() int {
+	return c.routePoints.withDefaults().Max
+}
+
+// ddDestination returns the name of the Datadog destination for a team's metrics
+func (c *AlertsConsumer) ddDestination(team string) string {
+	if dest, ok := c.teamDestinations[team]; ok {
+		return dest
+	}
+	return defaultDDDestination
+}
+
+// ddClient returns the client for a Datadog destination, falling back to the default
+// organization for destinations that aren't configured
+func (c *AlertsConsumer) ddClient(destination string) *ddClient {
+	if dest, ok := c.ddDestinations[destination]; ok {
+		return dest
+	}
+	return c.ddDestinations[defaultDDDestination]
 }
 
 // Initialize - we don't currently need to do any custom initialization
@@ -62,6 +181,41 @@ func (c *AlertsConsumer) ProcessMessage(rawmsg []byte) (msg []byte, tags []strin
 	return c.encodeMessage(fields, len(rawmsg))
 }
 
+// logTitle identifies the kind of a log as source/title, e.g. "oauth/login_start". Logs without
+// a source use their app's name, and logs without a title use "-".
+func logTitle(fields map[string]interface{}, app string) string {
+	source, _ := fields["source"].(string)
+	if source == "" {
+		source = app
+	}
+	if source == "" {
+		source = "unknown"
+	}
+	title, _ := fields["title"].(string)
+	if title == "" {
+		title = "-"
+	}
+	return source + "/" + title
+}
+
+// normalizeLogLevel returns the kayvee level of a log's level field, e.g. "WARN" => "warning"
+func normalizeLogLevel(level interface{}) string {
+	l, ok := level.(string)
+	if !ok {
+		return ""
+	}
+	l = strings.ToLower(l)
+	switch l {
+	case "warn":
+		return "warning"
+	case "err":
+		return "error"
+	case "crit", "fatal", "panic":
+		return "critical"
+	}
+	return l
+}
+
 type EncodeOutput struct {
 	DDMetrics []datadog.MetricSeries
 	CWMetrics []*cloudwatch.MetricDatum
@@ -77,7 +231,7 @@ func contains(slice []string, s string) bool {
 	return false
 }
 
-func (c *AlertsConsumer) encodeMessage(fields map[string]interface{}, numBytes int) ([]byte, []string, error) {
+func (c *AlertsConsumer) encodeMessage(fields map[string]interface{}, numBytes int) (_ []byte, _ []string, err error) {
 	// Determine routes
 	// KVMeta Routes
 	kvmeta := decode.ExtractKVMeta(fields)
@@ -87,7 +241,10 @@ func (c *AlertsConsumer) encodeMessage(fields map[string]interface{}, numBytes i
 	if team == "" {
 		team = kvmeta.Team
 	}
-	recordMetrics(env, app, team, numBytes, kvmeta.Routes.RuleNames())
+	recordMetrics(env, app, team, logTitle(fields, app), numBytes, kvmeta.Routes.RuleNames())
+	if level := normalizeLogLevel(fields["level"]); contains(c.logLevels, level) {
+		recordLogLevel(env, app, level)
+	}
 
 	routes := kvmeta.Routes.AlertRoutes()
 	for idx := range routes {
@@ -98,9 +255,27 @@ func (c *AlertsConsumer) encodeMessage(fields map[string]interface{}, numBytes i
 	routes = append(routes, globalRoutes(fields)...)
 	routes = append(routes, globalRoutesWithCustomFields(&fields)...)
 
+	// routeSeries are the series emitted by each route, for accounting of what routes cost
+	routeSeries := make([][]string, len(routes))
+	// routeErrs are the first error of each route. A route's errors skip its points, but not the
+	// other routes of the log.
+	routeErrs := make([]error, len(routes))
+	// skipped are the outcomes of routes that were denied or suppressed, so they aren't accounted
+	// as emitted when other routes of the log are
+	skipped := make([]string, len(routes))
+	defer func() {
+		recordRouteCosts(env, app, team, routes, routeSeries, routeErrs, skipped, numBytes, err)
+	}()
+
+	// Every log counts towards quotas, but only the routes of logs over them are suppressed
+	withinQuota := c.quotas.add(app, team, numBytes)
 	if len(routes) <= 0 {
 		return nil, nil, kbc.ErrMessageIgnored
 	}
+	if !withinQuota {
+		recordCounter("log_quota_suppressed", 1, "application:"+app)
+		return nil, nil, kbc.ErrMessageIgnored
+	}
 
 	// For backwards compatibility, add `Hostname` field (capitalized)
 	hostname, ok := fields["hostname"]
@@ -123,117 +298,288 @@ func (c *AlertsConsumer) encodeMessage(fields map[string]interface{}, numBytes i
 	// It is used to set a tag to group data points together before pushing to CloudWatch.
 	tag := "default"
 
-	for _, route := range routes {
-		// Look up dimensions (custom + default)
-		tags := []string{}
-		cwDims := []*cloudwatch.Dimension{}
-		for _, dim := range route.Dimensions {
-			if dimVal, ok := fields[dim]; ok {
-				var val string
-				switch t := dimVal.(type) {
-				case string:
-					val = t
-				case float64:
-					// Drop data after the decimal and cast to string (ex. 3.2 => "3")
-					val = fmt.Sprintf("%.0f", t)
-				case bool:
-					val = fmt.Sprintf("%t", t)
-				default:
-					return []byte{}, []string{}, fmt.Errorf(
-						"error casting dimension value. rule=%s dim=%s val=%s",
-						route.RuleName, dim, dimVal,
-					)
-				}
-				tags = append(tags, dim+":"+val)
-				if !contains(defaultDimensions, dim) {
-					cwDims = append(cwDims, &cloudwatch.Dimension{
-						Name:  aws.String(dim),
-						Value: &val,
-					})
-				}
-			}
+	for idx, route := range routes {
+		r := c.emitRoute(fields, route, timestamp, env, app, team)
+		routeSeries[idx], routeErrs[idx], skipped[idx] = r.series, r.err, r.skipped
+		eo.DDMetrics = append(eo.DDMetrics, r.ddMetrics...)
+		if len(r.cwMetrics) > 0 {
+			eo.CWMetrics = append(eo.CWMetrics, r.cwMetrics...)
+			tag = r.region
 		}
+	}
 
-		// 3 cases
-		// 	(1) val exists and it's a float
-		// 	(2) val exists but it's NOT a float (error)
-		// 	(3) val doesn't exist => use default value
-		val, valOk := fields[route.ValueField].(float64)
-		if !valOk {
-			valInterface, valueFieldExists := fields[route.ValueField]
-			if valueFieldExists {
-				// case (2)
-				return []byte{}, []string{}, fmt.Errorf(
-					"value exists but is wrong type. rule=%s value_field=%s value=%s",
-					route.RuleName, route.ValueField, valInterface,
-				)
+	// Every route was denied, suppressed or failed. The log only fails if its routes did.
+	if len(eo.DDMetrics) == 0 {
+		for _, routeErr := range routeErrs {
+			if routeErr != nil {
+				return []byte{}, []string{}, routeErr
 			}
 		}
+		return nil, nil, kbc.ErrMessageIgnored
+	}
 
-		var (
-			metricValue float64
-			metricType  datadog.MetricIntakeType
-		)
-		switch route.StatType {
-		case "counter":
-			metricType = datadog.METRICINTAKETYPE_COUNT
-			metricValue = 1
-			if valOk {
-				metricValue = val
+	out, err := json.Marshal(&eo)
+	if err != nil {
+		return []byte{}, []string{}, err
+	}
+
+	return out, []string{destinationTag(c.ddDestination(team), tag)}, nil
+}
+
+// routeResult is what a route emits for one log
+type routeResult struct {
+	ddMetrics []datadog.MetricSeries
+	cwMetrics []*cloudwatch.MetricDatum
+	// region is the CloudWatch region of cwMetrics
+	region string
+	// series are the series emitted, for accounting of what routes cost
+	series []string
+	// skipped is the outcome of a route that was denied or suppressed
+	skipped string
+	// err is the first error of the route. Its errors skip their points, but not the route's
+	// other points.
+	err error
+}
+
+// fail records an error of route, and keeps it if it's the route's first
+func (r *routeResult) fail(route decode.AlertRoute, team, reason string, err error) {
+	recordRouteError(route, team, reason, err)
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// emitRoute returns the points a route emits for a log logged at timestamp
+func (c *AlertsConsumer) emitRoute(fields map[string]interface{}, route decode.AlertRoute, timestamp time.Time, env, app, team string) routeResult {
+	r := routeResult{}
+	dims, skipped := c.admitRoute(route, team)
+	if skipped != "" {
+		r.skipped = skipped
+		return r
+	}
+	if route.StatType != "counter" && route.StatType != "gauge" {
+		r.fail(route, team, routeErrorStatType, fmt.Errorf("invalid StatType: %s", route.StatType))
+		return r
+	}
+	seriesNames := c.series.names(route.Series)
+	values, elements, points := c.expandRoute(fields, route, len(seriesNames))
+	// The cap is on the route's total, since value fields and series names multiply the points
+	// of an array
+	if points > c.maxRoutePoints() {
+		r.fail(route, team, routeErrorTooManyPoints, fmt.Errorf(
+			"route expands to too many points. rule=%s points=%d max=%d",
+			route.RuleName, points, c.maxRoutePoints(),
+		))
+		return r
+	}
+	sampleRate, suppressed := c.limits.allow(route, points)
+	if suppressed != "" {
+		recordRouteSuppressed(env, app, route.RuleName, suppressed)
+		r.skipped = routeOutcomeSuppressed
+		return r
+	}
+
+	// The dimensions of an element are the same for every value field
+	type elementDims struct {
+		tags   []string
+		cwDims []*cloudwatch.Dimension
+		err    error
+	}
+	dimsByElement := map[string]elementDims{}
+
+	for i, value := range values {
+		for _, index := range elements[i] {
+			// Look up dimensions (custom + default)
+			ed, ok := dimsByElement[index]
+			if !ok {
+				ed.tags, ed.cwDims, ed.err = c.routeDimensions(fields, route, dims, index, team)
+				dimsByElement[index] = ed
+				if ed.err != nil {
+					r.fail(route, team, routeErrorDimensionType, ed.err)
+				}
 			}
-		case "gauge":
-			metricType = datadog.METRICINTAKETYPE_GAUGE
-			metricValue = 0
-			if valOk {
-				metricValue = val
+			if ed.err != nil {
+				continue
 			}
-		default:
-			return nil, nil, fmt.Errorf("invalid StatType: %s", route.StatType)
-		}
-
-		eo.DDMetrics = append(eo.DDMetrics, datadog.MetricSeries{
-			Metric: "kv." + route.Series,
-			Type:   metricType.Ptr(),
-			Tags:   tags,
-			Points: []datadog.MetricPoint{
-				{
-					Timestamp: datadog.PtrInt64(timestamp.Unix()),
-					Value:     aws.Float64(metricValue),
-				},
-			},
-		})
 
-		if _, ok := cloudwatchAllowList[route.Series]; ok {
-			dat := &cloudwatch.MetricDatum{
-				MetricName:        &route.Series,
-				Dimensions:        cwDims,
-				Value:             aws.Float64(metricValue),
-				Timestamp:         &timestamp,
-				StorageResolution: aws.Int64(1),
+			pointTimestamp, err := c.multiValue.timestamp(route, fields, index, timestamp)
+			if err != nil {
+				r.fail(route, team, routeErrorTimestampType, err)
+				continue
 			}
-			if region, ok := fields["region"].(string); ok {
-				tag = region
-				eo.CWMetrics = append(eo.CWMetrics, dat)
-			} else if podRegion, ok := fields["pod-region"].(string); ok {
-				tag = podRegion
-				eo.CWMetrics = append(eo.CWMetrics, dat)
-			} else {
-				lg.Error("region-missing")
+			metricValue, metricType, err := c.pointValue(fields, route, value, index, sampleRate)
+			if err != nil {
+				r.fail(route, team, routeErrorValueType, err)
+				continue
+			}
+
+			for _, series := range seriesNames {
+				series += value.suffix
+				ddMetric := c.series.ddMetric(series)
+				r.series = append(r.series, seriesID(ddMetric, ed.tags))
+				r.ddMetrics = append(r.ddMetrics, datadog.MetricSeries{
+					Metric: ddMetric,
+					Type:   metricType.Ptr(),
+					Tags:   ed.tags,
+					Points: []datadog.MetricPoint{
+						{
+							Timestamp: datadog.PtrInt64(pointTimestamp.Unix()),
+							Value:     aws.Float64(metricValue),
+						},
+					},
+				})
+
+				// The allowlist is of the route's own series, so that renaming a series keeps it
+				// in CloudWatch, under its new name
+				if _, ok := cloudwatchAllowList[route.Series+value.suffix]; ok {
+					dat := &cloudwatch.MetricDatum{
+						MetricName:        aws.String(c.series.cwMetric(series)),
+						Dimensions:        ed.cwDims,
+						Value:             aws.Float64(metricValue),
+						Timestamp:         aws.Time(pointTimestamp),
+						StorageResolution: aws.Int64(1),
+					}
+					if region, ok := fields["region"].(string); ok {
+						r.region = region
+						r.cwMetrics = append(r.cwMetrics, dat)
+					} else if podRegion, ok := fields["pod-region"].(string); ok {
+						r.region = podRegion
+						r.cwMetrics = append(r.cwMetrics, dat)
+					} else {
+						lg.Error("region-missing")
+					}
+				}
 			}
 		}
 	}
+	// Points that failed were allowed, but don't count towards the route's rate limit
+	c.limits.refund(route, points-len(r.series))
+	return r
+}
 
-	out, err := json.Marshal(&eo)
-	if err != nil {
-		return []byte{}, []string{}, err
+// admitRoute applies the series denylist and the dimension policies to a route. It returns the
+// dimensions the route may have, or the outcome of a route that's denied.
+func (c *AlertsConsumer) admitRoute(route decode.AlertRoute, team string) ([]string, string) {
+	if pattern := c.series.denied(route.Series); pattern != "" {
+		recordCounter("series_denied", 1, "route:"+route.RuleName, "series:"+route.Series)
+		return nil, routeOutcomeDenied
+	}
+	dims, stripped, reject := c.dimensionPolicies.apply(route.Series, route.Dimensions)
+	if reject {
+		recordCounter("dimension_policy_rejected", 1, "route:"+route.RuleName, "series:"+route.Series, "team:"+team)
+		return nil, routeOutcomeDenied
+	}
+	for _, dim := range stripped {
+		recordCounter("dimension_policy_stripped", 1, "route:"+route.RuleName, "dimension:"+dim, "team:"+team)
+	}
+	return dims, ""
+}
+
+// expandRoute returns the value fields of a route, the indexes of the elements each expands to,
+// and how many points they make for a route emitted as seriesNames series. Routes emit a point
+// per value field, and per element of value fields that are arrays or have a wildcard.
+func (c *AlertsConsumer) expandRoute(fields map[string]interface{}, route decode.AlertRoute, seriesNames int) ([]routeValue, [][]string, int) {
+	values := c.multiValue.values(route)
+	elements := make([][]string, len(values))
+	points := 0
+	for i := range values {
+		values[i].field = arrayField(fields, values[i].field)
+		elements[i] = expandField(fields, values[i].field)
+		points += seriesNames * len(elements[i])
+	}
+	return values, elements, points
+}
+
+// pointValue returns the value of a route's point for the element at index of a value field.
+// Counters of routes sampled at sampleRate are scaled up, so that their totals stay the same.
+func (c *AlertsConsumer) pointValue(fields map[string]interface{}, route decode.AlertRoute, value routeValue, index string, sampleRate float64) (float64, datadog.MetricIntakeType, error) {
+	// 3 cases
+	// 	(1) val exists and it's a number, or can be coerced to one
+	// 	(2) val exists but it's NOT a number (error)
+	// 	(3) val doesn't exist => use default value
+	valInterface, valueFieldExists := lookupField(fields, fieldAtIndex(value.field, index))
+	val, valOk := c.coercion.coerce(route, valInterface)
+	if !valOk && valueFieldExists {
+		// case (2)
+		return 0, 0, fmt.Errorf(
+			"value exists but is wrong type. rule=%s value_field=%s value=%s",
+			route.RuleName, value.field, valInterface,
+		)
+	}
+
+	if route.StatType == "counter" {
+		metricValue := 1.0
+		if valOk {
+			metricValue = val
+		}
+		return metricValue / sampleRate, datadog.METRICINTAKETYPE_COUNT, nil
+	}
+	metricValue := 0.0
+	if valOk {
+		metricValue = val
 	}
+	return metricValue, datadog.METRICINTAKETYPE_GAUGE, nil
+}
 
-	return out, []string{tag}, nil
+// routeDimensions looks up the dimensions of a route in fields, and returns them as Datadog tags
+// and CloudWatch dimensions. index is the element of the route's value field being emitted, for
+// dimensions of the same element.
+func (c *AlertsConsumer) routeDimensions(fields map[string]interface{}, route decode.AlertRoute, dims []string, index, team string) ([]string, []*cloudwatch.Dimension, error) {
+	tags := []string{}
+	cwDims := []*cloudwatch.Dimension{}
+	for _, path := range dims {
+		// Nested dimensions are named by their dotted path
+		dim := fieldName(path)
+		if dimVal, ok := lookupField(fields, fieldAtIndex(path, index)); ok {
+			var val string
+			switch t := dimVal.(type) {
+			case string:
+				val = t
+			case float64:
+				// Drop data after the decimal and cast to string (ex. 3.2 => "3")
+				val = fmt.Sprintf("%.0f", t)
+			case bool:
+				val = fmt.Sprintf("%t", t)
+			default:
+				return nil, nil, fmt.Errorf(
+					"error casting dimension value. rule=%s dim=%s val=%s",
+					route.RuleName, dim, dimVal,
+				)
+			}
+			if rule := c.pii.match(val); rule != nil && !contains(defaultDimensions, dim) {
+				recordCounter("pii_scrubbed", 1, "route:"+route.RuleName, "dimension:"+dim,
+					"pii:"+rule.name, "action:"+rule.action, "team:"+team)
+				if rule.action == piiReject {
+					continue
+				}
+				val = c.pii.apply(rule, val)
+			}
+			if tag := normalizeDDTag(dim + ":" + val); tag != "" {
+				// Tag keys are always lowercased, so only count changes to values
+				if tag != strings.ToLower(dim)+":"+val {
+					recordCounter("dd_tags_normalized", 1, "route:"+route.RuleName, "dimension:"+dim)
+				}
+				tags = append(tags, tag)
+			} else {
+				recordCounter("dd_tags_normalized", 1, "route:"+route.RuleName, "dimension:"+dim)
+			}
+			if !contains(defaultDimensions, dim) {
+				cwDims = append(cwDims, &cloudwatch.Dimension{
+					Name:  aws.String(dim),
+					Value: &val,
+				})
+			}
+		}
+	}
+	return tags, cwDims, nil
 }
 
 // SendBatch is called once per batch per tag
-// The tags should always be either "default" or an AWS region (e.g. "us-west-1")
+// The tags should always be either "default" or an AWS region (e.g. "us-west-1"), prefixed by
+// the Datadog destination when it isn't the default one (e.g. "eu/us-west-1")
 func (c *AlertsConsumer) SendBatch(batch [][]byte, tag string) error {
+	destination, region := splitDestinationTag(tag)
+
 	metrics := []datadog.MetricSeries{}
 	dats := []*cloudwatch.MetricDatum{}
 	for _, b := range batch {
@@ -254,26 +600,22 @@ func (c *AlertsConsumer) SendBatch(batch [][]byte, tag string) error {
 	}
 	updateMaxDelay(ts)
 
-	retry := retrier.New(retrier.ExponentialBackoff(5, 50*time.Millisecond), nil)
-
-	err := retry.Run(func() error {
-		lg.TraceD("dd-submit-metrics", logger.M{"point-count": len(metrics)})
-		ctx := datadog.NewDefaultContext(context.Background())
-		body := datadog.NewMetricPayload(metrics)
-		_, _, err := c.dd.SubmitMetrics(ctx, *body)
-		return err
-	})
+	dd := c.ddClient(destination)
+	err := dd.submit(metrics)
 	if err != nil {
-		lg.ErrorD("dd-submit-metrics", logger.M{"error": err.Error()})
+		lg.ErrorD("dd-submit-metrics", logger.M{"destination": dd.name, "error": err.Error()})
 		return kbc.PartialSendBatchError{ErrMessage: "failed to send metrics to datadog: " + err.Error(), FailedMessages: batch}
 	}
 
 	// only send to Cloudwatch if the tag is an AWS region
-	if api, ok := c.cwAPIs[tag]; ok {
-		lg.TraceD("cloudwatch-add-datapoints", logger.M{"point-count": len(dats)})
-		_, err = api.PutMetricData(&cloudwatch.PutMetricDataInput{
-			Namespace:  aws.String(cloudwatchNamespace),
-			MetricData: dats,
+	if api, ok := c.cwAPIs[region]; ok {
+		err = c.cwBreakers[region].run(func() error {
+			lg.TraceD("cloudwatch-add-datapoints", logger.M{"point-count": len(dats)})
+			_, err := api.PutMetricData(&cloudwatch.PutMetricDataInput{
+				Namespace:  aws.String(cloudwatchNamespace),
+				MetricData: dats,
+			})
+			return err
 		})
 		if err != nil {
 			lg.ErrorD("error-sending-to-cloudwatch", logger.M{"error": err.Error()})
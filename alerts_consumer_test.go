@@ -11,7 +11,11 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
+
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+	"github.com/Clever/amazon-kinesis-client-go/decode"
 )
 
 func TestProcessMessage(t *testing.T) {
@@ -37,7 +41,7 @@ func TestProcessMessage(t *testing.T) {
 				"district:ddd",
 				"title:login_start",
 				"auth_method:auth",
-				"Hostname:my-hostname",
+				"hostname:my-hostname",
 				"env:test-env",
 			},
 			Points: []datadog.MetricPoint{{
@@ -72,7 +76,7 @@ func TestProcessMessageSupportsCloudwatch(t *testing.T) {
 		DDMetrics: []datadog.MetricSeries{{
 			Metric: "kv.ContainerExitCount",
 			Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
-			Tags:   []string{"dimension1:dim", "Hostname:my-hostname", "env:test-env"},
+			Tags:   []string{"dimension1:dim", "hostname:my-hostname", "env:test-env"},
 			Points: []datadog.MetricPoint{
 				{
 					Timestamp: datadog.PtrInt64(timestamp.Unix()),
@@ -131,7 +135,7 @@ func TestEncodeMessage(t *testing.T) {
 
 	expectedPts := []datadog.MetricSeries{{
 		Metric: "kv.series-name",
-		Tags:   []string{"dim_a:dim_a_val", "dim_b:dim_b_val", "Hostname:my-hostname", "env:my-env"},
+		Tags:   []string{"dim_a:dim_a_val", "dim_b:dim_b_val", "hostname:my-hostname", "env:my-env"},
 		Points: []datadog.MetricPoint{{
 			Value:     aws.Float64(123),
 			Timestamp: aws.Int64(0),
@@ -182,7 +186,7 @@ func TestEncodeMessageWithNonStringDimensions(t *testing.T) {
 			"dim_a:dim_a_val",
 			"dim_float:3",
 			"dim_bool:true",
-			"Hostname:my-hostname",
+			"hostname:my-hostname",
 			"env:my-env",
 		},
 		Points: []datadog.MetricPoint{{
@@ -286,7 +290,7 @@ func TestEncodeMessageWithGauge(t *testing.T) {
 	expectedPts := []datadog.MetricSeries{{
 		Metric: "kv.series-name",
 		Type:   datadog.METRICINTAKETYPE_GAUGE.Ptr(),
-		Tags:   []string{"dim_a:dim_a_val", "dim_b:dim_b_val", "Hostname:my-hostname", "env:my-env"},
+		Tags:   []string{"dim_a:dim_a_val", "dim_b:dim_b_val", "hostname:my-hostname", "env:my-env"},
 		Points: []datadog.MetricPoint{
 			{
 				Timestamp: datadog.PtrInt64(0),
@@ -346,7 +350,7 @@ func TestEncodeMessageWithMultipleRoutes(t *testing.T) {
 			Tags: []string{
 				"dim_a:dim_a_val",
 				"dim_b:dim_b_val",
-				"Hostname:my-hostname",
+				"hostname:my-hostname",
 				"env:my-env",
 			},
 			Type: datadog.METRICINTAKETYPE_GAUGE.Ptr(),
@@ -360,7 +364,7 @@ func TestEncodeMessageWithMultipleRoutes(t *testing.T) {
 			Tags: []string{
 				"dim_a:dim_a_val",
 				"dim_b:dim_b_val",
-				"Hostname:my-hostname",
+				"hostname:my-hostname",
 				"env:my-env",
 			},
 			Type: datadog.METRICINTAKETYPE_GAUGE.Ptr(),
@@ -403,6 +407,242 @@ func TestEncodeMessageWithNoAlertsRoutes(t *testing.T) {
 	assert.Contains(t, err.Error(), "intentionally skipped")
 }
 
+func TestEncodeMessageCountsLogLevels(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableLogLevelMetrics(logLevelConfig{Enabled: true})
+
+	collectMetrics()
+	for _, level := range []string{"error", "WARN", "info", "fatal", "", "error"} {
+		input := map[string]interface{}{
+			"container_env": "production",
+			"container_app": "my-app",
+			"level":         level,
+		}
+		_, _, err := consumer.encodeMessage(input, 10)
+		assert.Equal(t, kbc.ErrMessageIgnored, err)
+	}
+
+	assert.Equal(t, map[logLevel]int{
+		{"production", "my-app", "error"}:    2,
+		{"production", "my-app", "warning"}:  1,
+		{"production", "my-app", "critical"}: 1,
+	}, collectMetrics().logLevelVolumes)
+}
+
+func TestEncodeMessageDoesntCountLogLevelsByDefault(t *testing.T) {
+	consumer := AlertsConsumer{}
+
+	collectMetrics()
+	input := map[string]interface{}{"container_app": "my-app", "level": "error"}
+	_, _, err := consumer.encodeMessage(input, 10)
+	assert.Equal(t, kbc.ErrMessageIgnored, err)
+
+	assert.Empty(t, collectMetrics().logLevelVolumes)
+}
+
+func TestEncodeMessageRecordsRouteCosts(t *testing.T) {
+	consumer := AlertsConsumer{}
+	input := func(dimA interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"container_env": "production",
+			"container_app": "my-app",
+			"dim_a":         dimA,
+			"Hostname":      "my-hostname",
+			"timestamp":     time.Unix(0, 0),
+			"_kvmeta": map[string]interface{}{
+				"team": "eng-team",
+				"routes": []interface{}{
+					map[string]interface{}{
+						"type":       "alerts",
+						"series":     "series-name",
+						"dimensions": []interface{}{"dim_a"},
+						"stat_type":  "counter",
+						"rule":       "rule-1",
+					},
+				},
+			},
+		}
+	}
+
+	collectMetrics()
+	for _, dimA := range []interface{}{"a", "b", "a", []string{"invalid"}} {
+		consumer.encodeMessage(input(dimA), 100)
+	}
+	_, _, err := consumer.encodeMessage(map[string]interface{}{"container_app": "my-app", "container_env": "production"}, 50)
+	assert.Equal(t, kbc.ErrMessageIgnored, err)
+
+	costs := collectMetrics().routeCosts
+	emitted := costs[routeCostKey{"production", "my-app", "eng-team", "rule-1", routeOutcomeEmitted}]
+	assert.Equal(t, 3, emitted.messages)
+	assert.Equal(t, 300, emitted.bytes)
+	assert.Equal(t, 3, emitted.points)
+	assert.Len(t, emitted.series, 2)
+
+	failed := costs[routeCostKey{"production", "my-app", "eng-team", "rule-1", routeOutcomeError}]
+	assert.Equal(t, routeCost{messages: 1, bytes: 100, series: map[uint64]struct{}{}}, failed)
+
+	ignored := costs[routeCostKey{"production", "my-app", "unknown", noRoute, routeOutcomeIgnored}]
+	assert.Equal(t, routeCost{messages: 1, bytes: 50, series: map[uint64]struct{}{}}, ignored)
+}
+
+func TestEncodeMessageRecordsSkippedRouteCosts(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableSeriesMapping(seriesConfig{Deny: []string{"legacy"}})
+	consumer.enableDimensionPolicies([]dimensionPolicyConfig{
+		{Series: "billing", Deny: []string{"user_id"}, Strict: true},
+	})
+	consumer.enableRouteLimits([]routeLimitConfig{{Rule: "login-rule", SampleRate: 0.25}})
+	consumer.limits.sample = func() float64 { return 0.5 }
+
+	input := seriesTestInput("legacy", "billing", "login", "logout")
+	routes := input["_kvmeta"].(map[string]interface{})["routes"].([]interface{})
+	routes[1].(map[string]interface{})["dimensions"] = []interface{}{"user_id"}
+	input["user_id"] = "user-1"
+	input["container_env"] = "production"
+	input["container_app"] = "my-app"
+	collectMetrics()
+	_, _, err := consumer.encodeMessage(input, 100)
+	assert.NoError(t, err)
+
+	// Only the route that emitted points is accounted as emitted
+	costs := collectMetrics().routeCosts
+	key := func(rule, outcome string) routeCostKey {
+		return routeCostKey{"production", "my-app", "eng-team", rule, outcome}
+	}
+	assert.Equal(t, 1, costs[key("legacy-rule", routeOutcomeDenied)].messages)
+	assert.Equal(t, 1, costs[key("billing-rule", routeOutcomeDenied)].messages)
+	assert.Equal(t, 1, costs[key("login-rule", routeOutcomeSuppressed)].messages)
+	assert.Equal(t, 1, costs[key("logout-rule", routeOutcomeEmitted)].points)
+	for _, rule := range []string{"legacy-rule", "billing-rule", "login-rule"} {
+		assert.NotContains(t, costs, key(rule, routeOutcomeEmitted))
+	}
+}
+
+func TestAdmitRoute(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableSeriesMapping(seriesConfig{Deny: []string{"legacy"}})
+	consumer.enableDimensionPolicies([]dimensionPolicyConfig{
+		{Series: "billing", Deny: []string{"user_id"}, Strict: true},
+		{Series: "login", Deny: []string{"user_id"}},
+	})
+	route := func(series string) decode.AlertRoute {
+		return decode.AlertRoute{RuleName: series + "-rule", Series: series, Dimensions: []string{"district", "user_id"}}
+	}
+
+	dims, skipped := consumer.admitRoute(route("legacy"), "eng-team")
+	assert.Nil(t, dims)
+	assert.Equal(t, routeOutcomeDenied, skipped)
+	dims, skipped = consumer.admitRoute(route("billing"), "eng-team")
+	assert.Nil(t, dims)
+	assert.Equal(t, routeOutcomeDenied, skipped)
+	dims, skipped = consumer.admitRoute(route("login"), "eng-team")
+	assert.Equal(t, []string{"district"}, dims)
+	assert.Empty(t, skipped)
+	dims, skipped = consumer.admitRoute(route("logout"), "eng-team")
+	assert.Equal(t, []string{"district", "user_id"}, dims)
+	assert.Empty(t, skipped)
+}
+
+func TestExpandRoute(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableMultiValueRoutes([]multiValueConfig{
+		{Rule: "batch-rule", ValueFields: []string{"batch.*.millis", "count"}},
+	})
+	fields := map[string]interface{}{
+		"batch": []interface{}{
+			map[string]interface{}{"millis": float64(1)},
+			map[string]interface{}{"millis": float64(2)},
+		},
+		"count": float64(2),
+	}
+	route := decode.AlertRoute{RuleName: "batch-rule", Series: "batch", ValueField: "value"}
+
+	// Each value field makes a point per element, for each of the route's series names
+	values, elements, points := consumer.expandRoute(fields, route, 2)
+	assert.Equal(t, []routeValue{
+		{field: "batch.*.millis", suffix: ".millis"},
+		{field: "count", suffix: ".count"},
+	}, values)
+	assert.Equal(t, [][]string{{"0", "1"}, {""}}, elements)
+	assert.Equal(t, 6, points)
+}
+
+func TestPointValue(t *testing.T) {
+	consumer := AlertsConsumer{}
+	fields := map[string]interface{}{"value": float64(3), "invalid": "three"}
+	route := func(statType, valueField string) decode.AlertRoute {
+		return decode.AlertRoute{RuleName: "my-rule", StatType: statType, ValueField: valueField}
+	}
+
+	tests := []struct {
+		desc       string
+		route      decode.AlertRoute
+		sampleRate float64
+		value      float64
+		metricType datadog.MetricIntakeType
+	}{
+		{"counter", route("counter", "value"), 1, 3, datadog.METRICINTAKETYPE_COUNT},
+		{"counter without a value", route("counter", "missing"), 1, 1, datadog.METRICINTAKETYPE_COUNT},
+		{"sampled counter", route("counter", "value"), 0.25, 12, datadog.METRICINTAKETYPE_COUNT},
+		{"gauge", route("gauge", "value"), 1, 3, datadog.METRICINTAKETYPE_GAUGE},
+		{"gauge without a value", route("gauge", "missing"), 1, 0, datadog.METRICINTAKETYPE_GAUGE},
+		{"sampled gauge", route("gauge", "value"), 0.25, 3, datadog.METRICINTAKETYPE_GAUGE},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			value, metricType, err := consumer.pointValue(fields, test.route, routeValue{field: test.route.ValueField}, "", test.sampleRate)
+			require.NoError(t, err)
+			assert.Equal(t, test.value, value)
+			assert.Equal(t, test.metricType, metricType)
+		})
+	}
+
+	_, _, err := consumer.pointValue(fields, route("gauge", "invalid"), routeValue{field: "invalid"}, "", 1)
+	assert.EqualError(t, err, "value exists but is wrong type. rule=my-rule value_field=invalid value=three")
+}
+
+func TestEmitRoute(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.limitRoutePoints(routePointsConfig{Max: 2})
+	timestamp := time.Unix(100, 0)
+	fields := map[string]interface{}{
+		"district": "abc123",
+		"batch":    []interface{}{float64(1), "invalid"},
+		"value":    float64(3),
+	}
+	route := func(series, statType, valueField string) decode.AlertRoute {
+		return decode.AlertRoute{
+			RuleName: series + "-rule", Series: series, StatType: statType, ValueField: valueField,
+			Dimensions: []string{"district"},
+		}
+	}
+
+	r := consumer.emitRoute(fields, route("my-series", "gauge", "value"), timestamp, "production", "my-app", "eng-team")
+	require.NoError(t, r.err)
+	assert.Empty(t, r.skipped)
+	require.Len(t, r.ddMetrics, 1)
+	assert.Equal(t, "kv.my-series", r.ddMetrics[0].Metric)
+	assert.Equal(t, []string{"district:abc123"}, r.ddMetrics[0].Tags)
+	assert.Equal(t, float64(3), *r.ddMetrics[0].Points[0].Value)
+	assert.Equal(t, []string{seriesID("kv.my-series", r.ddMetrics[0].Tags)}, r.series)
+	assert.Empty(t, r.cwMetrics)
+
+	// Points that fail are skipped, but not the route's other points
+	r = consumer.emitRoute(fields, route("batch", "gauge", "batch"), timestamp, "production", "my-app", "eng-team")
+	assert.EqualError(t, r.err, "value exists but is wrong type. rule=batch-rule value_field=batch.* value=invalid")
+	assert.Len(t, r.ddMetrics, 1)
+	assert.Len(t, r.series, 1)
+
+	r = consumer.emitRoute(fields, route("my-series", "histogram", "value"), timestamp, "production", "my-app", "eng-team")
+	assert.EqualError(t, r.err, "invalid StatType: histogram")
+	assert.Empty(t, r.ddMetrics)
+
+	consumer.limitRoutePoints(routePointsConfig{Max: 1})
+	r = consumer.emitRoute(fields, route("batch", "gauge", "batch"), timestamp, "production", "my-app", "eng-team")
+	assert.EqualError(t, r.err, "route expands to too many points. rule=batch-rule points=2 max=1")
+	assert.Empty(t, r.ddMetrics)
+}
+
 type MockCW struct {
 	cloudwatchiface.CloudWatchAPI
 	inputs []*cloudwatch.PutMetricDataInput
@@ -415,11 +655,14 @@ func (cw *MockCW) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwat
 
 type MockDD struct {
 	DDMetricsAPI
-	inputs []datadog.MetricSeries
+	inputs  []datadog.MetricSeries
+	apiKeys []string
 }
 
 func (dd *MockDD) SubmitMetrics(ctx context.Context, body datadog.MetricPayload, o ...datadog.SubmitMetricsOptionalParameters) (datadog.IntakePayloadAccepted, *http.Response, error) {
 	dd.inputs = append(dd.inputs, body.Series...)
+	keys, _ := ctx.Value(datadog.ContextAPIKeys).(map[string]datadog.APIKey)
+	dd.apiKeys = append(dd.apiKeys, keys["apiKeyAuth"].Key)
 	return datadog.IntakePayloadAccepted{}, nil, nil
 }
 
@@ -497,10 +740,7 @@ func TestSendBatch(t *testing.T) {
 		"us-west-1": mockCWUSWest1,
 	}
 	mockDD := &MockDD{}
-	consumer := AlertsConsumer{
-		cwAPIs: mockCWs,
-		dd:     mockDD,
-	}
+	consumer := NewAlertsConsumer(mockDD, "", mockCWs)
 	err = consumer.SendBatch(input, "default")
 	assert.NoError(t, err)
 	assert.Equal(t, pts, mockDD.inputs)
@@ -589,10 +829,7 @@ func TestSendBatchToCloudwatch(t *testing.T) {
 		"us-west-1": mockCWUSWest1,
 	}
 	mockDD := &MockDD{}
-	consumer := AlertsConsumer{
-		cwAPIs: mockCWs,
-		dd:     mockDD,
-	}
+	consumer := NewAlertsConsumer(mockDD, "", mockCWs)
 	t.Log("Send batch")
 	err = consumer.SendBatch(input, "us-west-1")
 	assert.NoError(t, err)
@@ -673,10 +910,7 @@ func TestSendBatchWithMultipleEntries(t *testing.T) {
 		"us-west-1": &mockCWUSWest1,
 	}
 	mockDD := &MockDD{}
-	consumer := AlertsConsumer{
-		cwAPIs: mockCWs,
-		dd:     mockDD,
-	}
+	consumer := NewAlertsConsumer(mockDD, "", mockCWs)
 	t.Log("Send batch with multiple entries")
 	err = consumer.SendBatch(input, "default")
 	assert.NoError(t, err)
@@ -685,3 +919,114 @@ func TestSendBatchWithMultipleEntries(t *testing.T) {
 	assert.Equal(t, "kv.series-name", mockDD.inputs[0].Metric)
 	assert.Equal(t, "kv.series-name-4", mockDD.inputs[3].Metric)
 }
+
+func TestEncodeMessageRoutesTeamToDatadogDestination(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.addDDDestination(&ddClient{name: "eu"}, []string{"eu-team"})
+
+	input := map[string]interface{}{
+		"rawlog":    "...",
+		"title":     "my-title",
+		"timestamp": time.Unix(0, 0),
+		"region":    "us-west-1",
+		"_kvmeta": map[string]interface{}{
+			"team": "eu-team",
+			"routes": []interface{}{
+				map[string]interface{}{
+					"type":   "alerts",
+					"series": "series-name",
+					"rule":   "rule-1",
+				},
+			},
+		},
+	}
+	_, tags, err := consumer.encodeMessage(input, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"eu/default"}, tags)
+
+	input["team"] = "other-team"
+	_, tags, err = consumer.encodeMessage(input, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default"}, tags)
+}
+
+func TestDDClientFallsBackToTheDefaultDestination(t *testing.T) {
+	consumer := NewAlertsConsumer(&MockDD{}, "", nil)
+	consumer.addDDDestination(&ddClient{name: "eu"}, []string{"eu-team"})
+	consumer.enableCircuitBreakers(breakerConfig{})
+
+	dd := consumer.ddClient("removed")
+	assert.Equal(t, defaultDDDestination, dd.name)
+	// The default client is built once, so it keeps its circuit breaker
+	assert.Same(t, dd, consumer.ddClient(defaultDDDestination))
+	assert.NotNil(t, dd.breaker)
+	assert.Equal(t, "eu", consumer.ddClient("eu").name)
+}
+
+func TestSendBatchToDatadogDestination(t *testing.T) {
+	pts := []datadog.MetricSeries{
+		{
+			Metric: "kv.series-name",
+			Tags:   []string{"Hostname:my-hostname"},
+			Points: []datadog.MetricPoint{{
+				Value:     aws.Float64(1),
+				Timestamp: aws.Int64(0),
+			}},
+			Type: datadog.METRICINTAKETYPE_COUNT.Ptr(),
+		},
+	}
+	dats := []*cloudwatch.MetricDatum{
+		{
+			MetricName: aws.String("series-name"),
+			Value:      aws.Float64(1),
+		},
+	}
+	b, err := json.Marshal(EncodeOutput{DDMetrics: pts, CWMetrics: dats})
+	assert.NoError(t, err)
+
+	mockCWUSWest1 := &MockCW{}
+	mockDD := &MockDD{}
+	mockDDEU := &MockDD{}
+	consumer := NewAlertsConsumer(mockDD, "", map[string]cloudwatchiface.CloudWatchAPI{
+		"us-west-1": mockCWUSWest1,
+	})
+	consumer.addDDDestination(&ddClient{name: "eu", api: mockDDEU, apiKey: "eu-key"}, []string{"eu-team"})
+
+	err = consumer.SendBatch([][]byte{b}, "eu/us-west-1")
+	assert.NoError(t, err)
+	assert.Empty(t, mockDD.inputs)
+	assert.Equal(t, pts, mockDDEU.inputs)
+	assert.Equal(t, []string{"eu-key"}, mockDDEU.apiKeys)
+	assert.Len(t, mockCWUSWest1.inputs, 1)
+
+	// Unknown destinations fall back to the default organization
+	err = consumer.SendBatch([][]byte{b}, "removed/default")
+	assert.NoError(t, err)
+	assert.Equal(t, pts, mockDD.inputs)
+}
+
+func TestProcessMessageSendsOOMKillsToCloudwatch(t *testing.T) {
+	consumer := AlertsConsumer{
+		deployEnv: "test-env",
+	}
+	rawmsg := `2017-08-15T18:39:07.000000+00:00 my-hostname production--my-app/arn%3Aaws%3Aecs%3Aus-west-1%3A589690932525%3Atask%2Fbe5eafc1-8e44-489a-8942-aaaaaaaaaaaa[3337]: Memory cgroup out of memory: Killed process 31337 (node) total-vm:1620348kB`
+	msg, tags, err := consumer.ProcessMessage([]byte(rawmsg))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"us-west-1"}, tags)
+
+	eo := EncodeOutput{}
+	err = json.Unmarshal(msg, &eo)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "kv.ContainerOOMKillCount", eo.DDMetrics[0].Metric)
+	assert.Equal(t, []string{
+		"oom_app:my-app",
+		"container_env:production",
+		"region:us-west-1",
+		"oom_source:kernel",
+	}, eo.DDMetrics[0].Tags)
+	if assert.Len(t, eo.CWMetrics, 1) {
+		assert.Equal(t, "ContainerOOMKillCount", *eo.CWMetrics[0].MetricName)
+		assert.Len(t, eo.CWMetrics[0].Dimensions, 4)
+	}
+}
@@ -7,4 +7,7 @@ package main
 // gets large we will have to reduce the batch count in main.go
 var cloudwatchAllowList = map[string]struct{}{
 	"ContainerExitCount": {},
+	// Emitted by global routes
+	"ContainerExitCodeCount": {},
+	"ContainerOOMKillCount":  {},
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerHalfOpen = "half-open"
+	breakerOpen     = "open"
+)
+
+// breakerStateValues are the values of the circuit_breaker_state gauge
+var breakerStateValues = map[string]float64{
+	breakerClosed:   0,
+	breakerHalfOpen: 1,
+	breakerOpen:     2,
+}
+
+// errBreakerOpen is returned by sinkBreaker.run without sending while the breaker is open
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+var (
+	// sinkBreakers are the breakers of every sink by name, so their state can be shipped with the
+	// volume metrics. A new breaker for a sink replaces the old one.
+	sinkBreakers   = map[string]*sinkBreaker{}
+	sinkBreakersMu sync.Mutex
+)
+
+// sinkBreaker is a circuit breaker around the sends to one sink. ErrorThreshold failed sends, each
+// within Timeout of the last, open it. While it is open, sends fail immediately instead of
+// retrying against a sink that is down. Timeout after opening it's half-open, and lets sends
+// through to probe whether the sink has recovered: SuccessThreshold successes in a row close it,
+// and a failure opens it again.
+//
+// A nil *sinkBreaker runs every send.
+type sinkBreaker struct {
+	sink             string
+	errorThreshold   int
+	successThreshold int
+	timeout          time.Duration
+	now              func() time.Time
+
+	mu        sync.Mutex
+	state     string
+	errors    int
+	lastError time.Time
+	openedAt  time.Time
+	successes int
+}
+
+func newSinkBreaker(sink string, config breakerConfig) *sinkBreaker {
+	config = config.withDefaults()
+	s := &sinkBreaker{
+		sink:             sink,
+		errorThreshold:   config.ErrorThreshold,
+		successThreshold: config.SuccessThreshold,
+		timeout:          config.Timeout,
+		now:              time.Now,
+		state:            breakerClosed,
+	}
+
+	sinkBreakersMu.Lock()
+	sinkBreakers[sink] = s
+	sinkBreakersMu.Unlock()
+	return s
+}
+
+// run calls send unless the breaker is open, in which case it returns errBreakerOpen
+func (s *sinkBreaker) run(send func() error) error {
+	if s == nil {
+		return send()
+	}
+
+	s.mu.Lock()
+	if s.stateLocked() == breakerOpen {
+		s.mu.Unlock()
+		recordCounter("circuit_breaker_rejections", 1, "sink:"+s.sink)
+		return errBreakerOpen
+	}
+	s.mu.Unlock()
+
+	err := send()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	switch s.stateLocked() {
+	case breakerClosed:
+		if err == nil {
+			break
+		}
+		if s.errors > 0 && now.Sub(s.lastError) > s.timeout {
+			s.errors = 0
+		}
+		s.errors++
+		s.lastError = now
+		if s.errors >= s.errorThreshold {
+			s.setState(breakerOpen, now)
+		}
+	case breakerHalfOpen:
+		if err != nil {
+			s.setState(breakerOpen, now)
+		} else if s.successes++; s.successes >= s.successThreshold {
+			s.setState(breakerClosed, now)
+		}
+	case breakerOpen:
+		// Another send opened the breaker while this one was in flight
+	}
+	return err
+}
+
+// stateLocked returns the state of the breaker, moving it from open to half-open once its
+// timeout has passed
+func (s *sinkBreaker) stateLocked() string {
+	if s.state == breakerOpen {
+		if now := s.now(); now.Sub(s.openedAt) >= s.timeout {
+			s.setState(breakerHalfOpen, now)
+		}
+	}
+	return s.state
+}
+
+// setState moves the breaker to state at now, starting to count errors and successes over
+func (s *sinkBreaker) setState(state string, now time.Time) {
+	if state == breakerOpen {
+		s.openedAt = now
+	}
+	lg.InfoD("circuit-breaker-state-change", logger.M{"sink": s.sink, "from": s.state, "to": state})
+	s.state = state
+	s.errors = 0
+	s.successes = 0
+}
+
+// currentState returns the state of the breaker
+func (s *sinkBreaker) currentState() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stateLocked()
+}
+
+// breakerStates returns the state of every breaker by sink
+func breakerStates() map[string]string {
+	sinkBreakersMu.Lock()
+	defer sinkBreakersMu.Unlock()
+	states := map[string]string{}
+	for sink, s := range sinkBreakers {
+		states[sink] = s.currentState()
+	}
+	return states
+}
+
+// breakerConfig configures the circuit breakers of sinks
+type breakerConfig struct {
+	// ErrorThreshold is how many failed sends, without an error-free period of Timeout, open the breaker
+	ErrorThreshold int `yaml:"error_threshold"`
+	// SuccessThreshold is how many successful probes close the breaker again
+	SuccessThreshold int `yaml:"success_threshold"`
+	// Timeout is how long the breaker stays open before probing
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c breakerConfig) withDefaults() breakerConfig {
+	if c.ErrorThreshold <= 0 {
+		c.ErrorThreshold = 5
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = 1
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Minute
+	}
+	return c
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSinkBreaker(t *testing.T) {
+	b := newSinkBreaker("test-sink", breakerConfig{ErrorThreshold: 2, SuccessThreshold: 2, Timeout: time.Minute})
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	fail := func() error { return errors.New("sink is down") }
+	succeed := func() error { return nil }
+
+	assert.Error(t, b.run(fail))
+	assert.Equal(t, breakerClosed, b.currentState())
+	assert.Error(t, b.run(fail))
+	// Open as soon as the errors reach the threshold, before any send is rejected
+	assert.Equal(t, breakerOpen, b.currentState())
+
+	// Open: sends aren't attempted
+	sent := false
+	err := b.run(func() error { sent = true; return nil })
+	assert.Equal(t, errBreakerOpen, err)
+	assert.False(t, sent)
+	assert.Equal(t, breakerOpen, breakerStates()["test-sink"])
+
+	// Half-open once the timeout has passed, before the probe: a failed probe opens it again
+	now = now.Add(time.Minute)
+	assert.Equal(t, breakerHalfOpen, b.currentState())
+	assert.Equal(t, breakerHalfOpen, breakerStates()["test-sink"])
+	assert.Equal(t, "sink is down", b.run(fail).Error())
+	assert.Equal(t, breakerOpen, b.currentState())
+	assert.Equal(t, errBreakerOpen, b.run(succeed))
+
+	// Half-open: enough successful probes close it
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.run(succeed))
+	assert.Equal(t, breakerHalfOpen, b.currentState())
+	assert.NoError(t, b.run(succeed))
+	assert.Equal(t, breakerClosed, b.currentState())
+}
+
+func TestSinkBreakerForgetsOldErrors(t *testing.T) {
+	b := newSinkBreaker("test-sink", breakerConfig{ErrorThreshold: 2, Timeout: time.Minute})
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	fail := func() error { return errors.New("sink is down") }
+
+	assert.Error(t, b.run(fail))
+	now = now.Add(2 * time.Minute)
+	assert.Error(t, b.run(fail))
+	assert.Equal(t, breakerClosed, b.currentState())
+}
+
+func TestSinkBreakersAreReplacedBySink(t *testing.T) {
+	old := newSinkBreaker("replaced-sink", breakerConfig{ErrorThreshold: 1})
+	assert.Error(t, old.run(func() error { return errors.New("sink is down") }))
+	newSinkBreaker("replaced-sink", breakerConfig{})
+	assert.Equal(t, breakerClosed, breakerStates()["replaced-sink"])
+}
+
+func TestNilSinkBreakerRunsEverySend(t *testing.T) {
+	var b *sinkBreaker
+	for i := 0; i < 10; i++ {
+		assert.Error(t, b.run(func() error { return errors.New("sink is down") }))
+	}
+}
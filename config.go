@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// consumerConfig holds the settings read from config.yml
+type consumerConfig struct {
+	Datadog           datadogConfig           `yaml:"datadog"`
+	CircuitBreaker    breakerConfig           `yaml:"circuit_breaker"`
+	LogLevels         logLevelConfig          `yaml:"log_level_metrics"`
+	LogQuotas         []quotaConfig           `yaml:"log_quotas"`
+	TopTalkers        talkersConfig           `yaml:"top_talkers"`
+	VolumeSpikes      spikeConfig             `yaml:"volume_spikes"`
+	PII               piiConfig               `yaml:"pii"`
+	Series            seriesConfig            `yaml:"series"`
+	RouteLimits       []routeLimitConfig      `yaml:"route_limits"`
+	DimensionPolicies []dimensionPolicyConfig `yaml:"dimension_policies"`
+	ValueCoercion     []valueCoercionConfig   `yaml:"value_coercion"`
+	MultiValueRoutes  []multiValueConfig      `yaml:"multi_value_routes"`
+	RoutePoints       routePointsConfig       `yaml:"route_points"`
+}
+
+type datadogConfig struct {
+	// ddSettings apply to the default organization, and to destinations that don't override them
+	ddSettings `yaml:",inline"`
+	// Destinations send the metrics of specific teams to their own Datadog organization.
+	// Teams without a destination go to the default organization (DD_API_KEY).
+	Destinations []ddDestinationConfig `yaml:"destinations"`
+}
+
+type ddDestinationConfig struct {
+	ddSettings `yaml:",inline"`
+	Name       string `yaml:"name"`
+	// APIKeyEnv is the name of the environment variable holding the organization's API key
+	APIKeyEnv string   `yaml:"api_key_env"`
+	Teams     []string `yaml:"teams"`
+}
+
+// ddSettings configure how a Datadog organization is reached
+type ddSettings struct {
+	// Site is the Datadog site of the organization, e.g. datadoghq.eu or us3.datadoghq.com.
+	// Defaults to DD_SITE, or datadoghq.com.
+	Site string `yaml:"site"`
+	// ServerURL is the full URL of the intake, e.g. http://localhost:8080 for a fake intake.
+	// It takes precedence over Site.
+	ServerURL string `yaml:"server_url"`
+	// Compress deflates request payloads
+	Compress *bool         `yaml:"compress"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Proxy is the URL of an HTTP proxy. Defaults to HTTPS_PROXY / HTTP_PROXY.
+	Proxy string `yaml:"proxy"`
+}
+
+// ddSites are the Datadog sites supported by the API client
+var ddSites = []string{
+	"datadoghq.com",
+	"us3.datadoghq.com",
+	"us5.datadoghq.com",
+	"datadoghq.eu",
+	"ddog-gov.com",
+}
+
+// inherit fills settings that weren't set from parent
+func (s ddSettings) inherit(parent ddSettings) ddSettings {
+	if s.Site == "" && s.ServerURL == "" {
+		s.Site = parent.Site
+		s.ServerURL = parent.ServerURL
+	}
+	if s.Compress == nil {
+		s.Compress = parent.Compress
+	}
+	if s.Timeout == 0 {
+		s.Timeout = parent.Timeout
+	}
+	if s.Proxy == "" {
+		s.Proxy = parent.Proxy
+	}
+	return s
+}
+
+func (s ddSettings) validate() error {
+	if s.Site != "" && !contains(ddSites, s.Site) {
+		return fmt.Errorf("unsupported datadog site %s, must be one of %v", s.Site, ddSites)
+	}
+	if s.ServerURL != "" {
+		u, err := url.Parse(s.ServerURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid datadog server_url: %s", s.ServerURL)
+		}
+	}
+	if s.Proxy != "" {
+		u, err := url.Parse(s.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid datadog proxy: %s", s.Proxy)
+		}
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("invalid datadog timeout: %s", s.Timeout)
+	}
+	return nil
+}
+
+// logLevelConfig configures counting every app's logs by level
+type logLevelConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Levels are the levels that are counted. Defaults to error, critical and warning.
+	Levels []string `yaml:"levels"`
+}
+
+// logLevels are the kayvee log levels
+var logLevels = []string{"trace", "debug", "info", "warning", "error", "critical"}
+
+func (c logLevelConfig) withDefaults() logLevelConfig {
+	if len(c.Levels) == 0 {
+		c.Levels = []string{"error", "critical", "warning"}
+	}
+	return c
+}
+
+func (c logLevelConfig) validate() error {
+	for _, level := range c.Levels {
+		if !contains(logLevels, level) {
+			return fmt.Errorf("unsupported log level %s, must be one of %v", level, logLevels)
+		}
+	}
+	return nil
+}
+
+// loadConsumerConfig reads and validates the config file at path
+func loadConsumerConfig(path string) (consumerConfig, error) {
+	config := consumerConfig{}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return config, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	return config, config.validate()
+}
+
+// validateUnique validates every config of a section, and that no two of them are described the
+// same by describe, e.g. "route limit for rule/login-count". A nil describe allows duplicates.
+func validateUnique[T interface{ validate() error }](configs []T, describe func(T) string) error {
+	seen := map[string]struct{}{}
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		if describe == nil {
+			continue
+		}
+		d := describe(config)
+		if _, ok := seen[d]; ok {
+			return fmt.Errorf("duplicate %s", d)
+		}
+		seen[d] = struct{}{}
+	}
+	return nil
+}
+
+func (c consumerConfig) validate() error {
+	if err := c.Datadog.ddSettings.validate(); err != nil {
+		return err
+	}
+	if err := c.LogLevels.validate(); err != nil {
+		return err
+	}
+	if err := c.TopTalkers.validate(); err != nil {
+		return err
+	}
+	if err := c.VolumeSpikes.validate(); err != nil {
+		return err
+	}
+	if err := c.PII.validate(); err != nil {
+		return err
+	}
+	if err := c.Series.validate(); err != nil {
+		return err
+	}
+	if err := validateUnique(c.LogQuotas, func(q quotaConfig) string {
+		return fmt.Sprintf("%s log quota for %s", q.withDefaults().Period, q.name())
+	}); err != nil {
+		return err
+	}
+	if err := validateUnique(c.DimensionPolicies, nil); err != nil {
+		return err
+	}
+	if err := validateUnique(c.ValueCoercion, func(v valueCoercionConfig) string {
+		return "value coercion for " + v.name()
+	}); err != nil {
+		return err
+	}
+	if err := c.RoutePoints.validate(); err != nil {
+		return err
+	}
+	if err := validateUnique(c.MultiValueRoutes, func(m multiValueConfig) string {
+		return "multi value route for " + m.name()
+	}); err != nil {
+		return err
+	}
+	if err := validateUnique(c.RouteLimits, func(l routeLimitConfig) string {
+		return "route limit for " + l.name()
+	}); err != nil {
+		return err
+	}
+
+	names := map[string]struct{}{}
+	teams := map[string]string{}
+	for _, dest := range c.Datadog.Destinations {
+		if dest.Name == "" {
+			return fmt.Errorf("datadog destination is missing a name")
+		}
+		if dest.Name == defaultDDDestination || strings.Contains(dest.Name, destinationTagSeparator) {
+			return fmt.Errorf("invalid datadog destination name: %s", dest.Name)
+		}
+		if _, ok := names[dest.Name]; ok {
+			return fmt.Errorf("duplicate datadog destination: %s", dest.Name)
+		}
+		names[dest.Name] = struct{}{}
+
+		if dest.APIKeyEnv == "" {
+			return fmt.Errorf("datadog destination %s is missing api_key_env", dest.Name)
+		}
+		if err := dest.ddSettings.validate(); err != nil {
+			return fmt.Errorf("datadog destination %s: %s", dest.Name, err)
+		}
+		for _, team := range dest.Teams {
+			if other, ok := teams[team]; ok {
+				return fmt.Errorf("team %s is routed to both %s and %s", team, other, dest.Name)
+			}
+			teams[team] = dest.Name
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// validateCase is a case of a table test of a config's validate. The config is valid if wantErr
+// is empty, and otherwise its error contains wantErr.
+type validateCase struct {
+	name    string
+	config  interface{ validate() error }
+	wantErr string
+}
+
+// testValidate runs a table test of validate
+func testValidate(t *testing.T, cases []validateCase) {
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConsumerConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "empty config",
+			config: consumerConfig{},
+		},
+		{
+			name: "valid destinations",
+			config: consumerConfig{Datadog: datadogConfig{Destinations: []ddDestinationConfig{
+				{Name: "eu", APIKeyEnv: "DD_API_KEY_EU", Teams: []string{"team-a"}, ddSettings: ddSettings{Site: "datadoghq.eu"}},
+				{Name: "us3", APIKeyEnv: "DD_API_KEY_US3", Teams: []string{"team-b", "team-c"}},
+			}}},
+		},
+		{
+			name:    "unsupported site",
+			config:  consumerConfig{Datadog: datadogConfig{ddSettings: ddSettings{Site: "datadoghq.fr"}}},
+			wantErr: "unsupported datadog site",
+		},
+		{
+			name: "invalid server url",
+			config: consumerConfig{Datadog: datadogConfig{Destinations: []ddDestinationConfig{
+				{Name: "eu", APIKeyEnv: "DD_API_KEY_EU", ddSettings: ddSettings{ServerURL: "localhost:8080"}},
+			}}},
+			wantErr: "invalid datadog server_url",
+		},
+		{
+			name: "reserved name",
+			config: consumerConfig{Datadog: datadogConfig{Destinations: []ddDestinationConfig{
+				{Name: "default", APIKeyEnv: "DD_API_KEY_EU"},
+			}}},
+			wantErr: "invalid datadog destination name",
+		},
+		{
+			name: "missing api key",
+			config: consumerConfig{Datadog: datadogConfig{Destinations: []ddDestinationConfig{
+				{Name: "eu"},
+			}}},
+			wantErr: "missing api_key_env",
+		},
+		{
+			name: "team routed twice",
+			config: consumerConfig{Datadog: datadogConfig{Destinations: []ddDestinationConfig{
+				{Name: "eu", APIKeyEnv: "DD_API_KEY_EU", Teams: []string{"team-a"}},
+				{Name: "us3", APIKeyEnv: "DD_API_KEY_US3", Teams: []string{"team-a"}},
+			}}},
+			wantErr: "team team-a is routed to both eu and us3",
+		},
+		{
+			name:    "unsupported log level",
+			config:  consumerConfig{LogLevels: logLevelConfig{Enabled: true, Levels: []string{"error", "warn"}}},
+			wantErr: "unsupported log level warn",
+		},
+		{
+			name:    "volume spikes that clear above their start",
+			config:  consumerConfig{VolumeSpikes: spikeConfig{Enabled: true, Multiple: 3, ClearMultiple: 4}},
+			wantErr: "clear_multiple 4 must not be more than multiple 3",
+		},
+		{
+			name: "duplicate log quota",
+			config: consumerConfig{LogQuotas: []quotaConfig{
+				{Team: "team-a", MaxBytes: 1000},
+				{Team: "team-a", Period: quotaDaily, MaxLines: 1000},
+			}},
+			wantErr: "duplicate daily log quota for team/team-a",
+		},
+		{
+			name:    "negative top talkers capacity",
+			config:  consumerConfig{TopTalkers: talkersConfig{Capacity: -1}},
+			wantErr: "invalid top_talkers capacity -1",
+		},
+		{
+			name:    "more top talkers than capacity",
+			config:  consumerConfig{TopTalkers: talkersConfig{Capacity: 5, Top: 10}},
+			wantErr: "top_talkers top 10 must not be more than capacity 5",
+		},
+		{
+			name:    "negative route points",
+			config:  consumerConfig{RoutePoints: routePointsConfig{Max: -1}},
+			wantErr: "invalid route_points max -1",
+		},
+	})
+}
+
+func TestLoadConsumerConfig(t *testing.T) {
+	config, err := loadConsumerConfig("config.yml")
+	assert.NoError(t, err)
+	assert.Empty(t, config.Datadog.Destinations)
+}
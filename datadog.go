@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	datadog "github.com/DataDog/datadog-api-client-go/api/v2/datadog"
+	"github.com/eapache/go-resiliency/retrier"
+	"golang.org/x/net/context"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+const (
+	// defaultDDDestination is the Datadog organization configured by DD_API_KEY
+	defaultDDDestination = "default"
+	// destinationTagSeparator joins a Datadog destination and an AWS region in a batch tag
+	destinationTagSeparator = "/"
+	defaultDDTimeout        = 30 * time.Second
+)
+
+// ddClient submits metrics to a single Datadog organization
+type ddClient struct {
+	name string
+	api  DDMetricsAPI
+	// apiKey and site override DD_API_KEY and DD_SITE when set
+	apiKey string
+	site   string
+	// serverURL overrides site when set
+	serverURL *url.URL
+	compress  bool
+	// breaker stops submissions while Datadog is failing. It may be nil.
+	breaker *sinkBreaker
+}
+
+func newDefaultDDClient(api DDMetricsAPI) *ddClient {
+	return &ddClient{name: defaultDDDestination, api: api}
+}
+
+// newDDClient creates a client with its own HTTP client for a Datadog organization. An empty
+// apiKey uses DD_API_KEY.
+func newDDClient(name, apiKey string, settings ddSettings) (*ddClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.Proxy != "" {
+		proxyURL, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	timeout := settings.Timeout
+	if timeout == 0 {
+		timeout = defaultDDTimeout
+	}
+
+	cfg := datadog.NewConfiguration()
+	cfg.HTTPClient = &http.Client{Transport: transport, Timeout: timeout}
+
+	d := &ddClient{
+		name:     name,
+		api:      datadog.NewAPIClient(cfg).MetricsApi,
+		apiKey:   apiKey,
+		site:     settings.Site,
+		compress: settings.Compress != nil && *settings.Compress,
+	}
+	if settings.ServerURL != "" {
+		serverURL, err := url.Parse(settings.ServerURL)
+		if err != nil {
+			return nil, err
+		}
+		d.serverURL = serverURL
+	}
+	return d, nil
+}
+
+// context returns a request context authenticated for the client's organization
+func (d *ddClient) context() context.Context {
+	ctx := datadog.NewDefaultContext(context.Background())
+	if d.serverURL != nil {
+		// The second server of the API client is "{protocol}://{name}"
+		ctx = context.WithValue(ctx, datadog.ContextServerIndex, 1)
+		ctx = context.WithValue(ctx, datadog.ContextServerVariables, map[string]string{
+			"protocol": d.serverURL.Scheme,
+			"name":     d.serverURL.Host,
+		})
+	} else if d.site != "" {
+		ctx = context.WithValue(ctx, datadog.ContextServerVariables, map[string]string{"site": d.site})
+	}
+	if d.apiKey != "" {
+		ctx = context.WithValue(ctx, datadog.ContextAPIKeys, map[string]datadog.APIKey{
+			"apiKeyAuth": {Key: d.apiKey},
+		})
+	}
+	return ctx
+}
+
+// options returns the optional parameters for SubmitMetrics
+func (d *ddClient) options() []datadog.SubmitMetricsOptionalParameters {
+	if !d.compress {
+		return nil
+	}
+	return []datadog.SubmitMetricsOptionalParameters{
+		*datadog.NewSubmitMetricsOptionalParameters().WithContentEncoding(datadog.METRICCONTENTENCODING_DEFLATE),
+	}
+}
+
+// submit sends metrics to Datadog. Returns errBreakerOpen without sending if the
+// destination's circuit breaker is open.
+func (d *ddClient) submit(metrics []datadog.MetricSeries) error {
+	// Only errors that suggest Datadog is unavailable count towards opening the breaker
+	var permanent error
+	err := d.breaker.run(func() error {
+		err := d.submitWithRetries(metrics)
+		if ddErr, ok := err.(*ddError); ok && !ddErr.retryable() {
+			permanent = err
+			return nil
+		}
+		return err
+	})
+	if permanent != nil {
+		return permanent
+	}
+	return err
+}
+
+// submitWithRetries sends metrics to Datadog. Retryable errors are retried with exponential
+// backoff, or after the delay requested by Datadog if it is longer.
+func (d *ddClient) submitWithRetries(metrics []datadog.MetricSeries) error {
+	backoff := retrier.ExponentialBackoff(5, 50*time.Millisecond)
+
+	for attempt := 0; ; attempt++ {
+		lg.TraceD("dd-submit-metrics", logger.M{"destination": d.name, "point-count": len(metrics), "attempt": attempt})
+		_, res, err := d.api.SubmitMetrics(d.context(), *datadog.NewMetricPayload(metrics), d.options()...)
+		ddErr := classifyDDResponse(res, err)
+		if ddErr == nil {
+			recordCounter("dd_points_submitted", len(metrics), "destination:"+d.name)
+			return nil
+		}
+
+		recordCounter("dd_submit_errors", 1, "destination:"+d.name, "class:"+ddErr.class)
+		if !ddErr.retryable() || attempt >= len(backoff) {
+			return ddErr
+		}
+
+		wait := backoff[attempt]
+		if ddErr.retryAfter > wait {
+			wait = ddErr.retryAfter
+		}
+		time.Sleep(wait)
+	}
+}
+
+const (
+	ddErrRateLimited = "rate_limited"
+	ddErrServer      = "server"
+	ddErrTimeout     = "timeout"
+	ddErrTransport   = "transport"
+	ddErrPermanent   = "permanent"
+
+	// maxDDRetryAfter caps how long Datadog can ask us to wait before retrying
+	maxDDRetryAfter = 30 * time.Second
+)
+
+// ddError is a failed submission to Datadog
+type ddError struct {
+	// class is one of the ddErr* constants
+	class string
+	// status is the HTTP status of the response, or 0 if there wasn't one
+	status int
+	// messages are the errors listed in the response body
+	messages []string
+	// retryAfter is the delay requested by Datadog before retrying, if any
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *ddError) Error() string {
+	msg := fmt.Sprintf("datadog %s error", e.class)
+	if e.status != 0 {
+		msg += fmt.Sprintf(" status=%d", e.status)
+	}
+	if len(e.messages) > 0 {
+		msg += " errors=" + strings.Join(e.messages, "; ")
+	}
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *ddError) retryable() bool {
+	return e.class != ddErrPermanent
+}
+
+// classifyDDResponse returns the error for a SubmitMetrics call, or nil if it succeeded. The
+// response may be nil if the request was never sent or never answered.
+func classifyDDResponse(res *http.Response, err error) *ddError {
+	if res == nil {
+		if err == nil {
+			return nil
+		}
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return &ddError{class: ddErrTimeout, err: err}
+		}
+		return &ddError{class: ddErrTransport, err: err}
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 && err == nil {
+		return nil
+	}
+
+	ddErr := &ddError{status: res.StatusCode, messages: ddErrorMessages(res, err)}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		ddErr.class = ddErrRateLimited
+		ddErr.retryAfter = ddRetryAfter(res.Header)
+	case res.StatusCode == http.StatusRequestTimeout:
+		ddErr.class = ddErrTimeout
+	case res.StatusCode >= 500:
+		ddErr.class = ddErrServer
+		ddErr.retryAfter = ddRetryAfter(res.Header)
+	case res.StatusCode >= 400:
+		// e.g. 400 invalid payload, 403 invalid API key, 413 payload too large
+		ddErr.class = ddErrPermanent
+	default:
+		// a 2xx response whose body couldn't be decoded, or an unexpected status
+		ddErr.class = ddErrPermanent
+		ddErr.err = err
+	}
+	return ddErr
+}
+
+// ddErrorMessages reads the "errors" of a Datadog error response
+func ddErrorMessages(res *http.Response, err error) []string {
+	var body []byte
+	if apiErr, ok := err.(datadog.GenericOpenAPIError); ok {
+		body = apiErr.Body()
+	} else if res.Body != nil {
+		// Make a best attempt at reading the body
+		body, _ = ioutil.ReadAll(res.Body)
+	}
+
+	parsed := struct {
+		Errors []string `json:"errors"`
+	}{}
+	if json.Unmarshal(body, &parsed) == nil && len(parsed.Errors) > 0 {
+		return parsed.Errors
+	}
+	if len(body) > 0 {
+		return []string{string(body)}
+	}
+	return nil
+}
+
+// ddRetryAfter returns how long Datadog asked us to wait before retrying, from the Retry-After or
+// X-RateLimit-Reset headers
+func ddRetryAfter(header http.Header) time.Duration {
+	var wait time.Duration
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			wait = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			wait = time.Until(t)
+		}
+	} else if v := header.Get("X-RateLimit-Reset"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxDDRetryAfter {
+		return maxDDRetryAfter
+	}
+	return wait
+}
+
+// destinationTag returns the batch tag for a message going to a Datadog destination and AWS
+// region. The default destination uses the bare region, so that its tags stay "default" or a region.
+func destinationTag(destination, region string) string {
+	if destination == defaultDDDestination {
+		return region
+	}
+	return destination + destinationTagSeparator + region
+}
+
+// splitDestinationTag is the inverse of destinationTag
+func splitDestinationTag(tag string) (destination, region string) {
+	parts := strings.SplitN(tag, destinationTagSeparator, 2)
+	if len(parts) == 1 {
+		return defaultDDDestination, tag
+	}
+	return parts[0], parts[1]
+}
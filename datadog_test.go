@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	datadog "github.com/DataDog/datadog-api-client-go/api/v2/datadog"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/Clever/kinesis-alerts-consumer/testharness"
+)
+
+var testSeries = []datadog.MetricSeries{
+	{
+		Metric: "kv.series-name",
+		Tags:   []string{"env:test-env"},
+		Points: []datadog.MetricPoint{{
+			Value:     aws.Float64(1),
+			Timestamp: aws.Int64(1502822347),
+		}},
+		Type: datadog.METRICINTAKETYPE_COUNT.Ptr(),
+	},
+}
+
+func TestDDClientSubmitsToServerURL(t *testing.T) {
+	intake := testharness.NewDatadogIntake()
+	defer intake.Close()
+
+	compress := true
+	dd, err := newDDClient("eu", "eu-key", ddSettings{ServerURL: intake.URL, Compress: &compress})
+	assert.NoError(t, err)
+
+	assert.NoError(t, dd.submit(testSeries))
+	received := intake.Received()
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "eu-key", received[0].APIKey)
+		assert.Equal(t, "deflate", received[0].ContentEncoding)
+		assert.Equal(t, testSeries, received[0].Payload.Series)
+	}
+}
+
+func TestDDClientSubmitsThroughProxy(t *testing.T) {
+	proxy := testharness.NewDatadogIntake()
+	defer proxy.Close()
+
+	// The intake's hostname doesn't resolve, so the request can only succeed through the proxy
+	dd, err := newDDClient(defaultDDDestination, "key", ddSettings{
+		ServerURL: "http://intake.invalid",
+		Proxy:     proxy.URL,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, dd.submit(testSeries))
+	assert.Len(t, proxy.Series(), 1)
+}
+
+func TestDDSettingsInherit(t *testing.T) {
+	compress := true
+	parent := ddSettings{Site: "datadoghq.eu", Compress: &compress, Proxy: "http://proxy:3128"}
+
+	s := ddSettings{}.inherit(parent)
+	assert.Equal(t, parent, s)
+
+	s = ddSettings{ServerURL: "http://localhost:8080"}.inherit(parent)
+	assert.Equal(t, "", s.Site)
+	assert.Equal(t, "http://localhost:8080", s.ServerURL)
+	assert.Equal(t, &compress, s.Compress)
+}
+
+// TransportErrorDD fails like the Datadog client does when a request gets no response
+type TransportErrorDD struct {
+	DDMetricsAPI
+	calls int
+}
+
+func (dd *TransportErrorDD) SubmitMetrics(ctx context.Context, body datadog.MetricPayload, o ...datadog.SubmitMetricsOptionalParameters) (datadog.IntakePayloadAccepted, *http.Response, error) {
+	dd.calls++
+	return datadog.IntakePayloadAccepted{}, nil, errors.New("dial tcp: connection refused")
+}
+
+func TestDDClientHandlesNilResponse(t *testing.T) {
+	api := &TransportErrorDD{}
+	dd := newDefaultDDClient(api)
+
+	err := dd.submit(testSeries)
+	if assert.Error(t, err) {
+		assert.Equal(t, ddErrTransport, err.(*ddError).class)
+	}
+	assert.Equal(t, 6, api.calls)
+}
+
+func TestClassifyDDResponse(t *testing.T) {
+	response := func(status int, header http.Header, body string) *http.Response {
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+
+	tests := []struct {
+		name       string
+		res        *http.Response
+		err        error
+		want       *ddError
+		wantErrMsg string
+	}{
+		{
+			name: "accepted",
+			res:  response(202, nil, `{"errors": []}`),
+		},
+		{
+			name: "no response and no error",
+		},
+		{
+			name: "transport error",
+			err:  errors.New("connection reset by peer"),
+			want: &ddError{class: ddErrTransport, err: errors.New("connection reset by peer")},
+		},
+		{
+			name: "client timeout",
+			err:  context.DeadlineExceeded,
+			want: &ddError{class: ddErrTimeout, err: context.DeadlineExceeded},
+		},
+		{
+			name: "rate limited",
+			res:  response(429, http.Header{"X-Ratelimit-Reset": []string{"7"}}, `{"errors": ["Too many requests"]}`),
+			err:  errors.New("429 Too Many Requests"),
+			want: &ddError{class: ddErrRateLimited, status: 429, messages: []string{"Too many requests"}, retryAfter: 7 * time.Second},
+		},
+		{
+			name: "retry after is capped",
+			res:  response(503, http.Header{"Retry-After": []string{"3600"}}, ``),
+			err:  errors.New("503 Service Unavailable"),
+			want: &ddError{class: ddErrServer, status: 503, retryAfter: maxDDRetryAfter},
+		},
+		{
+			name: "request timeout",
+			res:  response(408, nil, `{"errors": ["Request timeout"]}`),
+			err:  errors.New("408 Request Timeout"),
+			want: &ddError{class: ddErrTimeout, status: 408, messages: []string{"Request timeout"}},
+		},
+		{
+			name:       "bad payload",
+			res:        response(400, nil, `{"errors": ["Payload is not in the expected format"]}`),
+			err:        errors.New("400 Bad Request"),
+			want:       &ddError{class: ddErrPermanent, status: 400, messages: []string{"Payload is not in the expected format"}},
+			wantErrMsg: "datadog permanent error status=400 errors=Payload is not in the expected format",
+		},
+		{
+			name: "forbidden with a non JSON body",
+			res:  response(403, nil, `Forbidden`),
+			err:  errors.New("403 Forbidden"),
+			want: &ddError{class: ddErrPermanent, status: 403, messages: []string{"Forbidden"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyDDResponse(tt.res, tt.err)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErrMsg != "" {
+				assert.Equal(t, tt.wantErrMsg, got.Error())
+			}
+		})
+	}
+}
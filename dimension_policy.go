@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// dimensionPolicyConfig restricts the dimensions of the routes of matching series
+type dimensionPolicyConfig struct {
+	// Exactly one of Series (path.Match syntax, e.g. "http.*") and SeriesRegex is set
+	Series      string `yaml:"series"`
+	SeriesRegex string `yaml:"series_regex"`
+	// Allow are the only dimensions routes may have, if set. The default dimensions are always
+	// allowed.
+	Allow []string `yaml:"allow"`
+	// Deny are dimensions routes may not have
+	Deny []string `yaml:"deny"`
+	// Strict rejects routes with dimensions that violate the policy, instead of stripping them
+	Strict bool `yaml:"strict"`
+}
+
+// name identifies the policy in errors
+func (c dimensionPolicyConfig) name() string {
+	if c.Series != "" {
+		return c.Series
+	}
+	return "/" + c.SeriesRegex + "/"
+}
+
+func (c dimensionPolicyConfig) validate() error {
+	if (c.Series == "") == (c.SeriesRegex == "") {
+		return fmt.Errorf("dimension policy must have exactly one of series and series_regex")
+	}
+	if c.Series != "" {
+		if _, err := path.Match(c.Series, ""); err != nil {
+			return fmt.Errorf("dimension policy %s has an invalid series pattern: %s", c.name(), err)
+		}
+	} else if _, err := regexp.Compile(c.SeriesRegex); err != nil {
+		return fmt.Errorf("dimension policy %s has an invalid series_regex: %s", c.name(), err)
+	}
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return fmt.Errorf("dimension policy %s must allow or deny dimensions", c.name())
+	}
+	return nil
+}
+
+type dimensionPolicy struct {
+	config dimensionPolicyConfig
+	re     *regexp.Regexp
+}
+
+func (p dimensionPolicy) matches(series string) bool {
+	if p.re != nil {
+		return p.re.MatchString(series)
+	}
+	ok, _ := path.Match(p.config.Series, series)
+	return ok
+}
+
+// allows returns whether a route may have dim
+func (p dimensionPolicy) allows(dim string) bool {
+	if contains(defaultDimensions, dim) {
+		return true
+	}
+	if contains(p.config.Deny, dim) {
+		return false
+	}
+	return len(p.config.Allow) == 0 || contains(p.config.Allow, dim)
+}
+
+// dimensionPolicies enforce which dimensions the routes of a series may have. Every policy that
+// matches a series applies to it.
+//
+// A nil *dimensionPolicies allows every dimension.
+type dimensionPolicies struct {
+	policies []dimensionPolicy
+}
+
+// newDimensionPolicies creates policies from validated configs
+func newDimensionPolicies(configs []dimensionPolicyConfig) *dimensionPolicies {
+	p := &dimensionPolicies{}
+	for _, config := range configs {
+		policy := dimensionPolicy{config: config}
+		if config.SeriesRegex != "" {
+			policy.re = regexp.MustCompile(config.SeriesRegex)
+		}
+		p.policies = append(p.policies, policy)
+	}
+	return p
+}
+
+// apply returns the dimensions of a route of series that the policies allow, and the ones they
+// strip. reject is true if a stripped dimension violates a strict policy.
+func (p *dimensionPolicies) apply(series string, dims []string) (allowed, stripped []string, reject bool) {
+	if p == nil {
+		return dims, nil, false
+	}
+	matching := []dimensionPolicy{}
+	for _, policy := range p.policies {
+		if policy.matches(series) {
+			matching = append(matching, policy)
+		}
+	}
+	if len(matching) == 0 {
+		return dims, nil, false
+	}
+
+	allowed = make([]string, 0, len(dims))
+	for _, dim := range dims {
+		ok := true
+		for _, policy := range matching {
+			if !policy.allows(dim) {
+				ok = false
+				reject = reject || policy.config.Strict
+			}
+		}
+		if ok {
+			allowed = append(allowed, dim)
+		} else {
+			stripped = append(stripped, dim)
+		}
+	}
+	return allowed, stripped, reject
+}
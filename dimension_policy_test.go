@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDimensionPolicies(t *testing.T) {
+	policies := newDimensionPolicies([]dimensionPolicyConfig{
+		{Series: "*", Deny: []string{"request_id"}},
+		{SeriesRegex: `^http\.`, Allow: []string{"http_method", "http_route"}},
+		{Series: "billing.*", Deny: []string{"user_id"}, Strict: true},
+	})
+
+	tests := []struct {
+		series   string
+		dims     []string
+		allowed  []string
+		stripped []string
+		reject   bool
+	}{
+		{
+			series:  "login",
+			dims:    []string{"district", "Hostname", "env"},
+			allowed: []string{"district", "Hostname", "env"},
+		},
+		{
+			series:   "login",
+			dims:     []string{"district", "request_id", "Hostname"},
+			allowed:  []string{"district", "Hostname"},
+			stripped: []string{"request_id"},
+		},
+		{
+			series:   "http.requests",
+			dims:     []string{"http_method", "request_id", "container_app", "env"},
+			allowed:  []string{"http_method", "env"},
+			stripped: []string{"request_id", "container_app"},
+		},
+		{
+			series:   "billing.charges",
+			dims:     []string{"district", "user_id"},
+			allowed:  []string{"district"},
+			stripped: []string{"user_id"},
+			reject:   true,
+		},
+		{
+			series:   "billing.charges",
+			dims:     []string{"district", "request_id"},
+			allowed:  []string{"district"},
+			stripped: []string{"request_id"},
+		},
+	}
+	for _, tt := range tests {
+		allowed, stripped, reject := policies.apply(tt.series, tt.dims)
+		assert.Equal(t, tt.allowed, allowed, tt.series)
+		assert.Equal(t, tt.stripped, stripped, tt.series)
+		assert.Equal(t, tt.reject, reject, tt.series)
+	}
+
+	var none *dimensionPolicies
+	allowed, stripped, reject := none.apply("login", []string{"request_id"})
+	assert.Equal(t, []string{"request_id"}, allowed)
+	assert.Empty(t, stripped)
+	assert.False(t, reject)
+}
+
+func TestDimensionPolicyConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "glob",
+			config: dimensionPolicyConfig{Series: "http.*", Deny: []string{"request_id"}},
+		},
+		{
+			name:   "regex",
+			config: dimensionPolicyConfig{SeriesRegex: `^http\.`, Allow: []string{"http_method"}, Strict: true},
+		},
+		{
+			name:    "series and regex",
+			config:  dimensionPolicyConfig{Series: "http.*", SeriesRegex: `^http\.`, Deny: []string{"request_id"}},
+			wantErr: "exactly one of series and series_regex",
+		},
+		{
+			name:    "invalid glob",
+			config:  dimensionPolicyConfig{Series: "http.[", Deny: []string{"request_id"}},
+			wantErr: "invalid series pattern",
+		},
+		{
+			name:    "invalid regex",
+			config:  dimensionPolicyConfig{SeriesRegex: `(http`, Deny: []string{"request_id"}},
+			wantErr: "invalid series_regex",
+		},
+		{
+			name:    "no dimensions",
+			config:  dimensionPolicyConfig{Series: "http.*"},
+			wantErr: "must allow or deny dimensions",
+		},
+	})
+}
+
+func TestEncodeMessageEnforcesDimensionPolicies(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableDimensionPolicies([]dimensionPolicyConfig{
+		{Series: "*", Deny: []string{"request_id"}},
+		{Series: "billing.*", Deny: []string{"user_id"}, Strict: true},
+	})
+
+	input := func(series string) map[string]interface{} {
+		return map[string]interface{}{
+			"request_id": "abc",
+			"user_id":    "jane",
+			"district":   "ddd",
+			"Hostname":   "my-hostname",
+			"timestamp":  time.Unix(0, 0),
+			"_kvmeta": map[string]interface{}{
+				"team": "eng-team",
+				"routes": []interface{}{
+					map[string]interface{}{
+						"type":       "alerts",
+						"series":     series,
+						"dimensions": []interface{}{"request_id", "user_id", "district"},
+						"stat_type":  "counter",
+						"rule":       series + "-rule",
+					},
+				},
+			},
+		}
+	}
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(input("login"), 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 1)
+	assert.Equal(t, []string{"user_id:jane", "district:ddd", "hostname:my-hostname"}, eo.DDMetrics[0].Tags)
+
+	_, _, err = consumer.encodeMessage(input("billing.charges"), 0)
+	assert.Equal(t, kbc.ErrMessageIgnored, err)
+
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("dimension_policy_stripped", "route:login-rule", "dimension:request_id", "team:eng-team")])
+	assert.Equal(t, 1, counters[newCounter("dimension_policy_rejected", "route:billing.charges-rule", "series:billing.charges", "team:eng-team")])
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+	datadog "github.com/DataDog/datadog-api-client-go/api/v2/datadog"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Clever/kinesis-alerts-consumer/testharness"
+)
+
+// e2eSetup starts fake sinks and a consumer that sends to them
+func e2eSetup(t *testing.T) (*AlertsConsumer, *testharness.DatadogIntake, *testharness.CloudWatch) {
+	intake := testharness.NewDatadogIntake()
+	t.Cleanup(intake.Close)
+	cw := testharness.NewCloudWatch()
+	t.Cleanup(cw.Close)
+
+	dd, err := newDDClient(defaultDDDestination, "test-key", ddSettings{ServerURL: intake.URL})
+	require.NoError(t, err)
+
+	consumer := NewAlertsConsumer(dd.api, "test-env", map[string]cloudwatchiface.CloudWatchAPI{
+		"us-west-1": cw.Client("us-west-1"),
+	})
+	consumer.addDDDestination(dd, nil)
+	return consumer, intake, cw
+}
+
+// runPipeline does what the batch consumer does with raw log lines: process each of them, then
+// send one batch per tag. It returns the errors of SendBatch by tag.
+func runPipeline(t *testing.T, c *AlertsConsumer, lines ...string) map[string]error {
+	batches := map[string][][]byte{}
+	tags := []string{}
+	for _, line := range lines {
+		msg, msgTags, err := c.ProcessMessage([]byte(line))
+		if err == kbc.ErrMessageIgnored {
+			continue
+		}
+		require.NoError(t, err)
+		for _, tag := range msgTags {
+			if _, ok := batches[tag]; !ok {
+				tags = append(tags, tag)
+			}
+			batches[tag] = append(batches[tag], msg)
+		}
+	}
+
+	errs := map[string]error{}
+	for _, tag := range tags {
+		errs[tag] = c.SendBatch(batches[tag], tag)
+	}
+	return errs
+}
+
+const (
+	e2eLoginLine         = `2017-08-15T18:39:07.000000+00:00 my-hostname production--my-app/arn%3Aaws%3Aecs%3Aus-west-1%3A589690932525%3Atask%2Fbe5eafc1-8e44-489a-8942-aaaaaaaaaaaa[3337]: {"level":"info","source":"oauth","title":"login_start","auth_method":"auth","district":"ddd","_kvmeta":{"team":"eng-team","kv_version":"3.8.2","kv_language":"js","routes":[{"type":"alerts","series":"oauth.login_start","dimensions":["district","auth_method"],"stat_type":"counter","value_field":"value","rule":"login-start"}]}}`
+	e2eContainerExitLine = `2017-08-15T18:39:07.000000+00:00 my-hostname production--my-app/arn%3Aaws%3Aecs%3Aus-west-1%3A589690932525%3Atask%2Fbe5eafc1-8e44-489a-8942-aaaaaaaaaaaa[3337]: {"_kvmeta":{"kv_language":"go","kv_version":"6.16.0","routes":[{"dimensions":["dimension1"],"rule":"unexpected-stop","series":"ContainerExitCount","stat_type":"counter","type":"alerts","value_field":"value"}],"team":"eng-infra"},"level":"info","title":"title","dimension1":"dim","region":"us-west-1","value":1}`
+	e2eUnroutedLine      = `2017-08-15T18:39:07.000000+00:00 my-hostname production--my-app/arn%3Aaws%3Aecs%3Aus-west-1%3A589690932525%3Atask%2Fbe5eafc1-8e44-489a-8942-aaaaaaaaaaaa[3337]: {"level":"info","title":"nothing-to-see"}`
+)
+
+func TestEndToEnd(t *testing.T) {
+	consumer, intake, cw := e2eSetup(t)
+
+	errs := runPipeline(t, consumer, e2eLoginLine, e2eContainerExitLine, e2eUnroutedLine)
+	assert.Equal(t, map[string]error{"default": nil, "us-west-1": nil}, errs)
+
+	received := intake.Received()
+	require.Len(t, received, 2)
+	assert.Equal(t, "test-key", received[0].APIKey)
+	assert.Equal(t, []datadog.MetricSeries{
+		{
+			Metric: "kv.oauth.login_start",
+			Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
+			Tags:   []string{"district:ddd", "auth_method:auth", "hostname:my-hostname", "env:test-env"},
+			Points: []datadog.MetricPoint{{Timestamp: aws.Int64(1502822347), Value: aws.Float64(1)}},
+		},
+		{
+			Metric: "kv.ContainerExitCount",
+			Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
+			Tags:   []string{"dimension1:dim", "hostname:my-hostname", "env:test-env"},
+			Points: []datadog.MetricPoint{{Timestamp: aws.Int64(1502822347), Value: aws.Float64(1)}},
+		},
+	}, intake.Series())
+
+	timestamp := time.Unix(1502822347, 0).UTC()
+	assert.Equal(t, []testharness.PutMetricDataRequest{{
+		Region:    "us-west-1",
+		Namespace: cloudwatchNamespace,
+		MetricData: []*cloudwatch.MetricDatum{{
+			MetricName:        aws.String("ContainerExitCount"),
+			Dimensions:        []*cloudwatch.Dimension{{Name: aws.String("dimension1"), Value: aws.String("dim")}},
+			Timestamp:         aws.Time(timestamp),
+			Value:             aws.Float64(1),
+			StorageResolution: aws.Int64(1),
+		}},
+	}}, cw.Received())
+}
+
+func TestEndToEndRetriesDatadogErrors(t *testing.T) {
+	consumer, intake, _ := e2eSetup(t)
+
+	intake.FailNext(testharness.DatadogFault(500, "Internal Server Error"))
+	errs := runPipeline(t, consumer, e2eLoginLine)
+	assert.NoError(t, errs["default"])
+	assert.Equal(t, 2, intake.Requests())
+	assert.Len(t, intake.Series(), 1)
+}
+
+func TestEndToEndFailsBatchWhenDatadogIsDown(t *testing.T) {
+	consumer, intake, cw := e2eSetup(t)
+
+	for i := 0; i < 6; i++ {
+		intake.FailNext(testharness.DatadogFault(503, "Service Unavailable"))
+	}
+	errs := runPipeline(t, consumer, e2eContainerExitLine)
+	require.Error(t, errs["us-west-1"])
+	assert.IsType(t, kbc.PartialSendBatchError{}, errs["us-west-1"])
+	assert.Empty(t, intake.Series())
+	// Nothing is sent to CloudWatch for a batch that will be retried
+	assert.Empty(t, cw.Received())
+}
+
+func TestEndToEndDoesntRetryPermanentDatadogErrors(t *testing.T) {
+	consumer, intake, _ := e2eSetup(t)
+
+	intake.FailNext(testharness.DatadogFault(403, "Forbidden"))
+	errs := runPipeline(t, consumer, e2eLoginLine)
+	require.Error(t, errs["default"])
+	assert.Contains(t, errs["default"].Error(), "datadog permanent error status=403 errors=Forbidden")
+	assert.Equal(t, 1, intake.Requests())
+}
+
+func TestEndToEndHonorsRetryAfter(t *testing.T) {
+	consumer, intake, _ := e2eSetup(t)
+
+	fault := testharness.DatadogFault(429, "Too many requests")
+	fault.Header.Set("Retry-After", "1")
+	intake.FailNext(fault)
+
+	start := time.Now()
+	errs := runPipeline(t, consumer, e2eLoginLine)
+	assert.NoError(t, errs["default"])
+	assert.True(t, time.Since(start) >= time.Second, "retried before Retry-After")
+	assert.Len(t, intake.Series(), 1)
+}
+
+func TestEndToEndCloudwatchErrorsDontFailBatch(t *testing.T) {
+	consumer, intake, cw := e2eSetup(t)
+
+	cw.FailNext(testharness.CloudWatchFault(400, "InvalidParameterValue", "bad metric"))
+	errs := runPipeline(t, consumer, e2eContainerExitLine)
+	assert.NoError(t, errs["us-west-1"])
+	assert.Len(t, intake.Series(), 1)
+	assert.Equal(t, 1, cw.Requests())
+	assert.Empty(t, cw.Received())
+}
+
+func TestEndToEndShipMetricsRetriesServerErrors(t *testing.T) {
+	_, intake, _ := e2eSetup(t)
+	dd, err := newDDClient(defaultDDDestination, "test-key", ddSettings{ServerURL: intake.URL})
+	require.NoError(t, err)
+
+	collectMetrics()
+	for i := 0; i < 3; i++ {
+		recordMetrics("test-env", "my-app", "eng-team", "my-app/-", 100, nil)
+	}
+	intake.FailNext(testharness.DatadogFault(502, "Bad Gateway"))
+	shipMetrics(dd)
+
+	require.True(t, intake.WaitForRequests(2, 5*time.Second))
+	metrics := map[string]float64{}
+	for _, s := range intake.Series() {
+		metrics[s.Metric] = *s.Points[0].Value
+	}
+	assert.Equal(t, float64(3), metrics["kinesis_alerts_consumer.log_volume_count"])
+	assert.Equal(t, float64(300), metrics["kinesis_alerts_consumer.log_volume_size"])
+}
+
+func TestEndToEndCircuitBreakerShortCircuitsDatadog(t *testing.T) {
+	consumer, intake, _ := e2eSetup(t)
+	consumer.enableCircuitBreakers(breakerConfig{ErrorThreshold: 1, Timeout: 200 * time.Millisecond})
+
+	for i := 0; i < 6; i++ {
+		intake.FailNext(testharness.DatadogFault(503, "Service Unavailable"))
+	}
+	errs := runPipeline(t, consumer, e2eLoginLine)
+	assert.Error(t, errs["default"])
+	assert.Equal(t, 6, intake.Requests())
+
+	// The breaker is open, so the batch fails without reaching Datadog
+	errs = runPipeline(t, consumer, e2eLoginLine)
+	require.Error(t, errs["default"])
+	assert.Contains(t, errs["default"].Error(), "circuit breaker is open")
+	assert.Equal(t, 6, intake.Requests())
+
+	// Once the timeout passes, a probe goes through and closes the breaker
+	time.Sleep(300 * time.Millisecond)
+	errs = runPipeline(t, consumer, e2eLoginLine)
+	assert.NoError(t, errs["default"])
+	assert.Len(t, intake.Series(), 1)
+	assert.Equal(t, breakerClosed, consumer.ddDestinations[defaultDDDestination].breaker.currentState())
+}
+
+func TestEndToEndPermanentErrorsDontOpenCircuitBreaker(t *testing.T) {
+	consumer, intake, _ := e2eSetup(t)
+	consumer.enableCircuitBreakers(breakerConfig{ErrorThreshold: 1, Timeout: time.Minute})
+
+	intake.FailNext(testharness.DatadogFault(400, "Payload is not in the expected format"))
+	errs := runPipeline(t, consumer, e2eLoginLine)
+	assert.Error(t, errs["default"])
+
+	errs = runPipeline(t, consumer, e2eLoginLine)
+	assert.NoError(t, errs["default"])
+	assert.Len(t, intake.Series(), 1)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// fieldWildcard is the path segment that expands an array into one point per element, e.g.
+	// "batch.*.millis"
+	fieldWildcard = "*"
+
+	defaultMaxRoutePoints = 100
+)
+
+// routePointsConfig bounds the points a route emits from one log, so that a log with a huge
+// array can't produce a batch larger than Datadog accepts
+type routePointsConfig struct {
+	// Max is the most points a route emits from one log, over all its value fields, array
+	// elements and series names. Routes with more fail. Defaults to 100.
+	Max int `yaml:"max"`
+}
+
+func (c routePointsConfig) withDefaults() routePointsConfig {
+	if c.Max == 0 {
+		c.Max = defaultMaxRoutePoints
+	}
+	return c
+}
+
+func (c routePointsConfig) validate() error {
+	if c.Max < 0 {
+		return fmt.Errorf("invalid route_points max %d, must be positive", c.Max)
+	}
+	return nil
+}
+
+// splitFieldPath splits a dotted path ("req.status") or a JSON pointer ("/req/status") into its
+// raw segments, and returns the separator
+func splitFieldPath(path string) ([]string, string) {
+	if strings.HasPrefix(path, "/") {
+		return strings.Split(path[1:], "/"), "/"
+	}
+	return strings.Split(path, "."), "."
+}
+
+// unescapePointer decodes a JSON pointer segment (RFC 6901)
+func unescapePointer(segment string) string {
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+}
+
+// fieldName is the name of the field at path in tags and dimensions. JSON pointers are named by
+// their dotted path, and wildcards are left out, e.g. "/batch/*/name" is "batch.name".
+func fieldName(path string) string {
+	if !strings.HasPrefix(path, "/") && !strings.Contains(path, fieldWildcard) {
+		return path
+	}
+	segments, sep := splitFieldPath(path)
+	names := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if segment == fieldWildcard {
+			continue
+		}
+		if sep == "/" {
+			segment = unescapePointer(segment)
+		}
+		names = append(names, segment)
+	}
+	return strings.Join(names, ".")
+}
+
+// lookupField returns the value at path in fields. A field whose name is the whole path wins, so
+// that flat fields with dots in their names are found as before. Otherwise the path is a dotted
+// path or a JSON pointer through nested objects, where array elements are selected by index,
+// e.g. "req.headers.0" or "/req/headers/0".
+func lookupField(fields map[string]interface{}, path string) (interface{}, bool) {
+	if val, ok := fields[path]; ok {
+		return val, true
+	}
+	segments, sep := splitFieldPath(path)
+	if len(segments) <= 1 && sep == "." {
+		return nil, false
+	}
+
+	var val interface{} = fields
+	for _, segment := range segments {
+		if sep == "/" {
+			segment = unescapePointer(segment)
+		}
+		switch t := val.(type) {
+		case map[string]interface{}:
+			v, ok := t[segment]
+			if !ok {
+				return nil, false
+			}
+			val = v
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(t) {
+				return nil, false
+			}
+			val = t[idx]
+		default:
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// expandField returns the indexes of the elements of the array that path's wildcard expands, so
+// that each can be looked up with fieldAtIndex. It returns [""] if path has no wildcard, and
+// nothing if the wildcard isn't an array.
+func expandField(fields map[string]interface{}, path string) []string {
+	segments, sep := splitFieldPath(path)
+	for i, segment := range segments {
+		if segment != fieldWildcard {
+			continue
+		}
+		prefix := strings.Join(segments[:i], sep)
+		if sep == "/" {
+			prefix = "/" + prefix
+		}
+		arr, ok := lookupField(fields, prefix)
+		elems, isArray := arr.([]interface{})
+		if !ok || !isArray {
+			return nil
+		}
+		indexes := make([]string, len(elems))
+		for idx := range elems {
+			indexes[idx] = strconv.Itoa(idx)
+		}
+		return indexes
+	}
+	return []string{""}
+}
+
+// arrayField returns path with a wildcard if it has none and its value is an array, so that a
+// value field that's an array, e.g. {"samples": [12, 80]}, emits a point per element
+func arrayField(fields map[string]interface{}, path string) string {
+	segments, sep := splitFieldPath(path)
+	for _, segment := range segments {
+		if segment == fieldWildcard {
+			return path
+		}
+	}
+	if val, ok := lookupField(fields, path); ok {
+		if _, isArray := val.([]interface{}); isArray {
+			return path + sep + fieldWildcard
+		}
+	}
+	return path
+}
+
+// fieldAtIndex replaces the wildcard of path with an index from expandField. Paths without a
+// wildcard are unchanged, so the dimensions of an expanded route can refer to the same element
+// as its value field, or to fields of the whole log.
+func fieldAtIndex(path, index string) string {
+	if index == "" {
+		return path
+	}
+	segments, sep := splitFieldPath(path)
+	for i, segment := range segments {
+		if segment == fieldWildcard {
+			segments[i] = index
+			if sep == "/" {
+				return "/" + strings.Join(segments, sep)
+			}
+			return strings.Join(segments, sep)
+		}
+	}
+	return path
+}
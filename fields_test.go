@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupField(t *testing.T) {
+	fields := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"status": 200,
+		"pod.region": "us-west-1",
+		"req": {"status": 500, "path": "/users", "headers": ["a", "b"], "a/b": {"~c": true}},
+		"batch": [{"millis": 10}, {"millis": 20}]
+	}`), &fields))
+
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{path: "status", want: float64(200), ok: true},
+		{path: "pod.region", want: "us-west-1", ok: true},
+		{path: "req.status", want: float64(500), ok: true},
+		{path: "/req/status", want: float64(500), ok: true},
+		{path: "req.headers.1", want: "b", ok: true},
+		{path: "/req/headers/0", want: "a", ok: true},
+		{path: "/req/a~1b/~0c", want: true, ok: true},
+		{path: "batch.1.millis", want: float64(20), ok: true},
+		{path: "req.headers.2"},
+		{path: "req.headers.x"},
+		{path: "req.status.code"},
+		{path: "missing"},
+		{path: "req.missing"},
+	}
+	for _, tt := range tests {
+		val, ok := lookupField(fields, tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.want, val, tt.path)
+	}
+}
+
+func TestExpandField(t *testing.T) {
+	fields := map[string]interface{}{
+		"batch": []interface{}{
+			map[string]interface{}{"millis": float64(10)},
+			map[string]interface{}{"millis": float64(20)},
+		},
+		"req": map[string]interface{}{"status": float64(500)},
+	}
+
+	assert.Equal(t, []string{""}, expandField(fields, "req.status"))
+	assert.Equal(t, []string{"0", "1"}, expandField(fields, "batch.*.millis"))
+	assert.Equal(t, []string{"0", "1"}, expandField(fields, "/batch/*/millis"))
+	assert.Empty(t, expandField(fields, "req.*.status"))
+	assert.Empty(t, expandField(fields, "missing.*.millis"))
+
+	assert.Equal(t, "batch.1.millis", fieldAtIndex("batch.*.millis", "1"))
+	assert.Equal(t, "/batch/1/millis", fieldAtIndex("/batch/*/millis", "1"))
+	assert.Equal(t, "req.status", fieldAtIndex("req.status", "1"))
+	assert.Equal(t, "batch.*.millis", fieldAtIndex("batch.*.millis", ""))
+
+	assert.Equal(t, "req.status", fieldName("/req/status"))
+	assert.Equal(t, "req.status", fieldName("req.status"))
+	assert.Equal(t, "batch.name", fieldName("batch.*.name"))
+	assert.Equal(t, "batch.name", fieldName("/batch/*/name"))
+}
+
+func TestEncodeMessageNestedFields(t *testing.T) {
+	consumer := AlertsConsumer{}
+
+	input := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"req": {"method": "GET", "millis": 12},
+		"batch": [{"name": "a", "millis": 10}, {"name": "b", "millis": 20}],
+		"Hostname": "my-hostname",
+		"_kvmeta": {
+			"team": "eng-team",
+			"routes": [
+				{
+					"type": "alerts",
+					"series": "request-millis",
+					"dimensions": ["/req/method"],
+					"stat_type": "gauge",
+					"value_field": "req.millis",
+					"rule": "request-millis"
+				},
+				{
+					"type": "alerts",
+					"series": "batch-millis",
+					"dimensions": ["batch.*.name", "req.method"],
+					"stat_type": "gauge",
+					"value_field": "batch.*.millis",
+					"rule": "batch-millis"
+				}
+			]
+		}
+	}`), &input))
+	input["timestamp"] = time.Unix(0, 0)
+
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 3)
+
+	assert.Equal(t, "kv.request-millis", eo.DDMetrics[0].Metric)
+	assert.Equal(t, []string{"req.method:get", "hostname:my-hostname"}, eo.DDMetrics[0].Tags)
+	assert.Equal(t, 12.0, *eo.DDMetrics[0].Points[0].Value)
+
+	assert.Equal(t, "kv.batch-millis", eo.DDMetrics[1].Metric)
+	assert.Equal(t, []string{"batch.name:a", "req.method:get", "hostname:my-hostname"}, eo.DDMetrics[1].Tags)
+	assert.Equal(t, 10.0, *eo.DDMetrics[1].Points[0].Value)
+	assert.Equal(t, []string{"batch.name:b", "req.method:get", "hostname:my-hostname"}, eo.DDMetrics[2].Tags)
+	assert.Equal(t, 20.0, *eo.DDMetrics[2].Points[0].Value)
+}
+
+func TestEncodeMessageLimitsExpandedPoints(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.limitRoutePoints(routePointsConfig{Max: 3})
+
+	input := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"small": [1, 2, 3],
+		"large": [1, 2, 3, 4],
+		"Hostname": "my-hostname",
+		"_kvmeta": {
+			"team": "eng-team",
+			"routes": [
+				{"type": "alerts", "series": "small", "dimensions": [], "stat_type": "gauge", "value_field": "small", "rule": "small-rule"},
+				{"type": "alerts", "series": "large", "dimensions": [], "stat_type": "gauge", "value_field": "large", "rule": "large-rule"}
+			]
+		}
+	}`), &input))
+	input["timestamp"] = time.Unix(0, 0)
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 3)
+	for _, m := range eo.DDMetrics {
+		assert.Equal(t, "kv.small", m.Metric)
+	}
+
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("route_errors", "route:large-rule", "reason:too_many_points", "team:eng-team")])
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -21,7 +23,6 @@ func globalRoutes(fields map[string]interface{}) []decode.AlertRoute {
 	// TODO: After initial migration, revisit these routes and ensure they all
 	// emit hostname+env via default dimensions
 	routes = append(routes, processMetricsRoutes(fields)...)
-	routes = append(routes, rdsSlowQueries(fields)...)
 
 	return routes
 }
@@ -32,6 +33,10 @@ func globalRoutesWithCustomFields(fields *map[string]interface{}) []decode.Alert
 	routes := []decode.AlertRoute{}
 
 	routes = append(routes, mongoSlowQueries(fields)...)
+	routes = append(routes, rdsSlowQueries(fields)...)
+	routes = append(routes, crashes(fields)...)
+	routes = append(routes, containerStops(fields)...)
+	routes = append(routes, httpAccessLogs(fields)...)
 
 	return routes
 }
@@ -95,7 +100,7 @@ func mongoSlowQueries(fields *map[string]interface{}) []decode.AlertRoute {
 
 	matches := reMongoSlowQuery.FindStringSubmatch(rawlog)
 	if len(matches) < 4 {
-		return []decode.AlertRoute{}
+		return mongoStructuredSlowQueries(fields, rawlog)
 	}
 
 	millis, err := strconv.ParseFloat(matches[3], 64)
@@ -135,28 +140,531 @@ func mongoSlowQueries(fields *map[string]interface{}) []decode.AlertRoute {
 	}
 }
 
-func rdsSlowQueries(fields map[string]interface{}) []decode.AlertRoute {
-	hostname, ok := fields["hostname"].(string)
+// mongoSlowQueryAttrs are the attributes of a MongoDB 4.4+ structured "Slow query" log that we use
+type mongoSlowQueryAttrs struct {
+	Type           string   `json:"type"`
+	NS             string   `json:"ns"`
+	AppName        string   `json:"appName"`
+	PlanSummary    string   `json:"planSummary"`
+	DurationMillis *float64 `json:"durationMillis"`
+}
+
+// mongoStructuredSlowQueries handles the JSON logs of MongoDB 4.4+, e.g.
+// {"t":{"$date":"..."},"s":"I","c":"COMMAND","id":51803,"ctx":"conn1","msg":"Slow query","attr":{"type":"command","ns":"clever.students","planSummary":"COLLSCAN","durationMillis":2964}}
+// They produce the same series as the legacy text logs, with the app name and plan as extra dimensions.
+func mongoStructuredSlowQueries(fields *map[string]interface{}, rawlog string) []decode.AlertRoute {
+	if !strings.Contains(rawlog, `"Slow query"`) {
+		return []decode.AlertRoute{}
+	}
+	log := struct {
+		Msg  string              `json:"msg"`
+		Attr mongoSlowQueryAttrs `json:"attr"`
+	}{}
+	firstIdx := strings.Index(rawlog, "{")
+	if firstIdx == -1 || json.Unmarshal([]byte(rawlog[firstIdx:]), &log) != nil {
+		return []decode.AlertRoute{}
+	}
+	if log.Msg != "Slow query" || log.Attr.DurationMillis == nil || log.Attr.NS == "" {
+		return []decode.AlertRoute{}
+	}
+
+	plan := "NONE"
+	// e.g. "IXSCAN { district: 1 }" => "IXSCAN"
+	if words := strings.Fields(log.Attr.PlanSummary); len(words) > 0 {
+		plan = words[0]
+	}
+
+	(*fields)["operation"] = log.Attr.Type
+	(*fields)["namespace"] = log.Attr.NS
+	(*fields)["is_collscan"] = strings.Contains(log.Attr.PlanSummary, "COLLSCAN")
+	(*fields)["millis"] = *log.Attr.DurationMillis
+	(*fields)["plan"] = plan
+	if log.Attr.AppName != "" {
+		(*fields)["app_name"] = log.Attr.AppName
+	}
+
+	dims := []string{
+		"hostname",
+		"operation",
+		"namespace",
+		"is_collscan",
+		"plan",
+		"app_name",
+	}
+	return []decode.AlertRoute{
+		{
+			Series:     "mongo.slow-query",
+			Dimensions: dims,
+			StatType:   statTypeCounter,
+			RuleName:   "global-mongo-slow-query-count",
+		},
+		{
+			Series:     "mongo.slow-query-millis",
+			Dimensions: dims,
+			StatType:   statTypeGauge,
+			ValueField: "millis",
+			RuleName:   "global-mongo-slow-query-gauge",
+		},
+	}
+}
+
+var (
+	// PostgreSQL with log_min_duration_statement and the default RDS log_line_prefix, e.g.
+	// "2021-06-01 10:00:00 UTC:10.0.0.1(5432):clever@mydb:[1234]:LOG:  duration: 1500.1 ms  statement: SELECT 1"
+	rePostgresSlowQuery = regexp.MustCompile(`(?m):([^:@\s]*)@([^:@\s]*):\[\d+\]:LOG:\s+duration: ([\d.]+) ms\s+(?:statement|execute [^:]*): (.*)$`)
+	// MySQL slow log headers
+	reMySQLQueryTime = regexp.MustCompile(`# Query_time: ([\d.]+)`)
+	reMySQLSchema    = regexp.MustCompile(`(?m)^\s*(?:use ([^;\s]+);|# Schema: (\S+))`)
+
+	reSQLVerb = regexp.MustCompile(`^\s*([A-Za-z]+)\b`)
+)
+
+// sqlVerbs are the statement verbs used as a dimension. Others are reported as OTHER.
+var sqlVerbs = []string{
+	"SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "MERGE", "WITH",
+	"CALL", "CREATE", "ALTER", "DROP", "TRUNCATE", "COPY", "VACUUM", "ANALYZE",
+	"BEGIN", "COMMIT", "ROLLBACK",
+}
+
+// rdsSlowQueries counts slow queries logged by RDS, and parses their duration, database, user
+// and statement verb from PostgreSQL and MySQL slow query logs
+func rdsSlowQueries(fields *map[string]interface{}) []decode.AlertRoute {
+	hostname, ok := (*fields)["hostname"].(string)
 	if !ok {
 		return []decode.AlertRoute{}
 	}
 	if hostname != "aws-rds" {
 		return []decode.AlertRoute{}
 	}
+	rawlog, _ := (*fields)["rawlog"].(string)
+
+	var parsed bool
+	if matches := rePostgresSlowQuery.FindStringSubmatch(rawlog); matches != nil {
+		if matches[1] == "rdsadmin" {
+			return []decode.AlertRoute{}
+		}
+		(*fields)["db_engine"] = "postgres"
+		(*fields)["db_user"] = matches[1]
+		(*fields)["db_name"] = matches[2]
+		if millis, err := strconv.ParseFloat(matches[3], 64); err == nil {
+			(*fields)["query_millis"] = millis
+			parsed = true
+		}
+		(*fields)["statement"] = sqlVerb(matches[4])
+	} else if matches := reMySQLQueryTime.FindStringSubmatch(rawlog); matches != nil {
+		// Only MySQL slow log entries have a Query_time header. Other RDS logs, e.g. PostgreSQL
+		// lines that aren't slow statements, aren't slow queries even if they have a user.
 
-	// filter out slowqueries by rdsadmin
-	user, ok := fields["user"].(string)
-	if !ok || user == "rdsadmin[rdsadmin]" {
+		// filter out slowqueries by rdsadmin
+		user, ok := (*fields)["user"].(string)
+		if !ok || user == "rdsadmin[rdsadmin]" {
+			return []decode.AlertRoute{}
+		}
+
+		// The user is formatted as "user[user]"
+		(*fields)["db_engine"] = "mysql"
+		(*fields)["db_user"] = strings.SplitN(user, "[", 2)[0]
+		if secs, err := strconv.ParseFloat(matches[1], 64); err == nil {
+			(*fields)["query_millis"] = secs * 1000
+			parsed = true
+		}
+		if matches := reMySQLSchema.FindStringSubmatch(rawlog); matches != nil {
+			(*fields)["db_name"] = matches[1] + matches[2]
+		}
+		if statement := mysqlStatement(rawlog); statement != "" {
+			(*fields)["statement"] = sqlVerb(statement)
+		}
+	} else {
 		return []decode.AlertRoute{}
 	}
 
-	return []decode.AlertRoute{
+	dims := []string{"env", "programname", "db_engine", "db_name", "db_user", "statement"}
+	routes := []decode.AlertRoute{
 		{
 			Series:     "rds.slow-query",
-			Dimensions: []string{"env", "programname"},
+			Dimensions: dims,
 			StatType:   statTypeCounter,
 			ValueField: defaultValueField,
 			RuleName:   "global-rds-slow-query-count",
 		},
 	}
+	if parsed {
+		routes = append(routes, decode.AlertRoute{
+			Series:     "rds.slow-query-millis",
+			Dimensions: dims,
+			StatType:   statTypeGauge,
+			ValueField: "query_millis",
+			RuleName:   "global-rds-slow-query-gauge",
+		})
+	}
+	return routes
+}
+
+// mysqlStatement returns the query of a MySQL slow log entry, skipping its headers and the
+// statements that set the session's timestamp and database
+func mysqlStatement(rawlog string) string {
+	for _, line := range strings.Split(rawlog, "\n") {
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+		if line == "" || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(lower, "set timestamp=") || strings.HasPrefix(lower, "use ") {
+			continue
+		}
+		return line
+	}
+	return ""
+}
+
+// sqlVerb normalizes the verb of a SQL statement, e.g. "select * from t" => "SELECT"
+func sqlVerb(statement string) string {
+	matches := reSQLVerb.FindStringSubmatch(statement)
+	if matches == nil {
+		return "OTHER"
+	}
+	verb := strings.ToUpper(matches[1])
+	if contains(sqlVerbs, verb) {
+		return verb
+	}
+	return "OTHER"
+}
+
+var (
+	reGoPanic      = regexp.MustCompile(`(?m)^(?:panic|fatal error): (.+?)\s*$`)
+	reNodeUncaught = regexp.MustCompile(`(?m)^(?:\(node:\d+\) )?(?:Uncaught Exception:|Uncaught|uncaughtException:|UnhandledPromiseRejectionWarning:)\s*([A-Z][A-Za-z]*(?:Error|Exception))\b`)
+	// Node prints the throwing line with a caret under it, a blank line, then "TypeError: message"
+	reNodeThrow           = regexp.MustCompile(`(?m)^\s*\^\s*\n\s*\n([A-Z][A-Za-z]*(?:Error|Exception))\b`)
+	reNodeUnhandledReject = regexp.MustCompile(`(?m)^\[UnhandledPromiseRejection:`)
+
+	// These strip the variable parts of panic messages, so that the error class has low cardinality
+	reCrashBrackets = regexp.MustCompile(`\s*\[[^\]]*\]`)
+	reCrashBounds   = regexp.MustCompile(` with (?:length|capacity) \d+`)
+	reCrashQuoted   = regexp.MustCompile(`"[^"]*"|'[^']*'`)
+	reCrashNumbers  = regexp.MustCompile(`\b(?:0x[0-9a-fA-F]+|\d+)\b`)
+)
+
+const maxCrashErrorClassLength = 100
+
+// crashes counts Go panics and fatal errors, and uncaught exceptions in Node, by the class of
+// error that crashed the app
+func crashes(fields *map[string]interface{}) []decode.AlertRoute {
+	rawlog, ok := (*fields)["rawlog"].(string)
+	if !ok {
+		return []decode.AlertRoute{}
+	}
+
+	var runtime, errorClass string
+	if matches := reGoPanic.FindStringSubmatch(rawlog); matches != nil {
+		runtime = "go"
+		errorClass = goPanicErrorClass(matches[1])
+	} else if matches := reNodeUncaught.FindStringSubmatch(rawlog); matches != nil {
+		runtime = "node"
+		errorClass = matches[1]
+	} else if matches := reNodeThrow.FindStringSubmatch(rawlog); matches != nil {
+		runtime = "node"
+		errorClass = matches[1]
+	} else if reNodeUnhandledReject.MatchString(rawlog) {
+		runtime = "node"
+		errorClass = "UnhandledPromiseRejection"
+	} else {
+		return []decode.AlertRoute{}
+	}
+
+	(*fields)["crash_runtime"] = runtime
+	(*fields)["error_class"] = errorClass
+
+	return []decode.AlertRoute{
+		{
+			Series: "crash",
+			Dimensions: []string{
+				"container_app",
+				"container_env",
+				"crash_runtime",
+				"error_class",
+			},
+			StatType: statTypeCounter,
+			RuleName: "global-crash-count",
+		},
+	}
+}
+
+// goPanicErrorClass turns a panic message into its class, e.g.
+// "runtime error: index out of range [5] with length 3" => "runtime error: index out of range"
+func goPanicErrorClass(msg string) string {
+	class := reCrashBrackets.ReplaceAllString(msg, "")
+	class = reCrashBounds.ReplaceAllString(class, "")
+	class = reCrashQuoted.ReplaceAllString(class, "*")
+	class = reCrashNumbers.ReplaceAllString(class, "N")
+	class = strings.Join(strings.Fields(class), " ")
+	if len(class) > maxCrashErrorClassLength {
+		class = class[:maxCrashErrorClassLength]
+	}
+	return class
+}
+
+var (
+	// e.g. "Memory cgroup out of memory: Killed process 1234 (node) total-vm:..."
+	reKernelOOMKill = regexp.MustCompile(`(?m)(?:Memory cgroup out of memory|Out of memory): Kill(?:ed)? process \d+ \(([^)]+)\)`)
+	// docker events, e.g. "container oom 7805c1d35632 (image=alpine, name=foo)"
+	reDockerOOM = regexp.MustCompile(`(?m)\bcontainer oom [0-9a-f]+ \((?:[^)]*\bname=([^,)]+))?`)
+	// e.g. "container die 7805c1d35632 (exitCode=137, image=alpine, name=foo)"
+	reDockerDie = regexp.MustCompile(`(?m)\bcontainer die [0-9a-f]+ \([^)]*\bexitCode=(\d+)`)
+	// ECS agent, e.g. "Task engine [arn:...]: container [name=app] ... exited with code 137"
+	reECSContainerExit = regexp.MustCompile(`(?m)^Task engine \[[^\]]+\]: .*\bcontainer\b.*\bexit(?:ed with)? code:? (\d+)`)
+	// ECS programnames contain the task ARN, e.g. "env--app/arn%3Aaws%3Aecs%3Aus-west-1%3A..."
+	reProgramnameRegion = regexp.MustCompile(`arn%3Aaws%3Aecs%3A([a-z]{2}-[a-z]+-\d)%3A`)
+	// EC2 private DNS hostnames, e.g. "ip-10-0-0-1.us-west-2.compute.internal", or
+	// "ip-10-0-0-1.ec2.internal" in us-east-1
+	reHostnameRegion = regexp.MustCompile(`\.(?:([a-z]{2}-[a-z]+-\d)\.compute|ec2)\.internal$`)
+)
+
+// containerStops counts containers killed by the OOM killer, and container exits by exit code.
+// OOM kills are usually logged by the host's kernel or docker daemon, not by the container, so
+// their app is oom_app: the app of the ECS task that logged it, or else the killed process or the
+// docker container name.
+//
+// Both are allow listed for Cloudwatch, so logs are given a region from their ECS task or EC2
+// hostname when they don't have one. Logs without either only go to Datadog.
+func containerStops(fields *map[string]interface{}) []decode.AlertRoute {
+	rawlog, ok := (*fields)["rawlog"].(string)
+	if !ok {
+		return []decode.AlertRoute{}
+	}
+
+	var route decode.AlertRoute
+	if matches := reKernelOOMKill.FindStringSubmatch(rawlog); matches != nil {
+		(*fields)["oom_source"] = "kernel"
+		(*fields)["oom_process"] = matches[1]
+		(*fields)["oom_app"] = matches[1]
+		route = decode.AlertRoute{
+			Series:     "ContainerOOMKillCount",
+			Dimensions: []string{"oom_app", "container_env", "region", "oom_source"},
+			StatType:   statTypeCounter,
+			RuleName:   "global-oom-kill-count",
+		}
+	} else if matches := reDockerOOM.FindStringSubmatch(rawlog); matches != nil {
+		(*fields)["oom_source"] = "docker"
+		(*fields)["oom_app"] = "unknown"
+		if matches[1] != "" {
+			(*fields)["oom_app"] = matches[1]
+		}
+		route = decode.AlertRoute{
+			Series:     "ContainerOOMKillCount",
+			Dimensions: []string{"oom_app", "container_env", "region", "oom_source"},
+			StatType:   statTypeCounter,
+			RuleName:   "global-oom-kill-count",
+		}
+	} else if matches := reDockerDie.FindStringSubmatch(rawlog); matches != nil {
+		(*fields)["exit_code"] = matches[1]
+		route = decode.AlertRoute{
+			Series:     "ContainerExitCodeCount",
+			Dimensions: []string{"container_app", "container_env", "region", "exit_code"},
+			StatType:   statTypeCounter,
+			RuleName:   "global-container-exit-code-count",
+		}
+	} else if matches := reECSContainerExit.FindStringSubmatch(rawlog); matches != nil {
+		(*fields)["exit_code"] = matches[1]
+		route = decode.AlertRoute{
+			Series:     "ContainerExitCodeCount",
+			Dimensions: []string{"container_app", "container_env", "region", "exit_code"},
+			StatType:   statTypeCounter,
+			RuleName:   "global-container-exit-code-count",
+		}
+	} else {
+		return []decode.AlertRoute{}
+	}
+
+	// OOM kills logged by an ECS task are of its own app
+	if _, ok := (*fields)["oom_app"]; ok {
+		programname, _ := (*fields)["programname"].(string)
+		if app, ok := (*fields)["container_app"].(string); ok && app != "" && reProgramnameRegion.MatchString(programname) {
+			(*fields)["oom_app"] = app
+		}
+	}
+
+	_, hasRegion := (*fields)["region"].(string)
+	_, hasPodRegion := (*fields)["pod-region"].(string)
+	if !hasRegion && !hasPodRegion {
+		if region := containerStopRegion(*fields); region != "" {
+			(*fields)["region"] = region
+		}
+	}
+
+	return []decode.AlertRoute{route}
+}
+
+// containerStopRegion returns the region of the ECS task in a log's programname, or of the EC2
+// host in its hostname, or "" if it has neither
+func containerStopRegion(fields map[string]interface{}) string {
+	if programname, ok := fields["programname"].(string); ok {
+		if matches := reProgramnameRegion.FindStringSubmatch(programname); matches != nil {
+			return matches[1]
+		}
+	}
+	if hostname, ok := fields["hostname"].(string); ok {
+		if matches := reHostnameRegion.FindStringSubmatch(hostname); matches != nil {
+			if matches[1] == "" {
+				return "us-east-1"
+			}
+			return matches[1]
+		}
+	}
+	return ""
+}
+
+var (
+	// Combined log format, optionally followed by the request time in seconds as nginx's
+	// $request_time, e.g.
+	// `10.0.0.1 - - [01/Jun/2021:10:00:00 +0000] "GET /students/5 HTTP/1.1" 200 512 "-" "curl/7.64.1" 0.153`
+	reCombinedAccessLog = regexp.MustCompile(`(?m)^\S+ \S+ \S+ \[[^\]]+\] "([A-Z]+) (\S+)(?: HTTP/[\d.]+)?" (\d{3}) (?:\d+|-)(?: "[^"]*" "[^"]*")?(?: ([\d.]+))?\s*$`)
+	// ALB access logs, e.g. `https 2021-06-01T10:00:00.000000Z app/my-lb/50dc6c495c0c9188
+	// 10.0.0.1:2817 10.0.1.2:80 0.000 0.153 0.000 200 200 34 366 "GET https://api.clever.com:443/students/5 HTTP/1.1" ...`
+	reALBAccessLog = regexp.MustCompile(`^(?:http|https|h2|grpcs|ws|wss) \S+ (\S+) \S+ \S+ (-?[\d.]+) (-?[\d.]+) (-?[\d.]+) (\d{3}) \S+ \d+ \d+ "([A-Z]+) (\S+) [^"]*"`)
+
+	// Path segments that are IDs, e.g. numbers, UUIDs, mongo ObjectIDs and other long tokens with digits
+	reRouteID = regexp.MustCompile(`^(?:\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{24}|[A-Za-z_-]*\d[\w-]{15,})$`)
+)
+
+const maxRouteSegments = 5
+
+// httpLatencyBuckets are the upper bounds, in milliseconds, of the buckets of http.request-latency
+var httpLatencyBuckets = []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// httpAccessLogs produces request, error and latency (RED) metrics from access logs in the
+// combined log format, ALB access logs, and the request-finished logs of the kayvee middleware
+func httpAccessLogs(fields *map[string]interface{}) []decode.AlertRoute {
+	var (
+		method, path string
+		status       int
+		millis       float64
+		hasLatency   bool
+	)
+
+	if title, _ := (*fields)["title"].(string); title == "request-finished" {
+		m, okMethod := (*fields)["method"].(string)
+		p, okPath := (*fields)["path"].(string)
+		s, okStatus := (*fields)["status-code"].(float64)
+		if !okMethod || !okPath || !okStatus {
+			return []decode.AlertRoute{}
+		}
+		method, path, status = m, p, int(s)
+		millis, hasLatency = (*fields)["response-time-ms"].(float64)
+	} else {
+		rawlog, ok := (*fields)["rawlog"].(string)
+		if !ok {
+			return []decode.AlertRoute{}
+		}
+		if matches := reALBAccessLog.FindStringSubmatch(rawlog); matches != nil {
+			(*fields)["load_balancer"] = matches[1]
+			method = matches[6]
+			if u, err := url.Parse(matches[7]); err == nil {
+				path = u.Path
+			}
+			status, _ = strconv.Atoi(matches[5])
+			// The processing times are -1 if the target couldn't be reached
+			hasLatency = true
+			for _, t := range matches[2:5] {
+				secs, err := strconv.ParseFloat(t, 64)
+				if err != nil || secs < 0 {
+					hasLatency = false
+					break
+				}
+				millis += secs * 1000
+			}
+		} else if matches := reCombinedAccessLog.FindStringSubmatch(rawlog); matches != nil {
+			method = matches[1]
+			path = matches[2]
+			status, _ = strconv.Atoi(matches[3])
+			if secs, err := strconv.ParseFloat(matches[4], 64); err == nil {
+				millis, hasLatency = secs*1000, true
+			}
+		} else {
+			return []decode.AlertRoute{}
+		}
+	}
+
+	route := httpRoute(path)
+	// Routes named by wag are better templates than the path
+	if op, ok := (*fields)["op"].(string); ok && op != "" {
+		route = op
+	}
+
+	(*fields)["http_method"] = method
+	(*fields)["http_route"] = route
+	(*fields)["http_status_class"] = fmt.Sprintf("%dxx", status/100)
+
+	dims := []string{"container_app", "container_env", "load_balancer", "http_method", "http_route"}
+	statusDims := append(append([]string{}, dims...), "http_status_class")
+	routes := []decode.AlertRoute{
+		{
+			Series:     "http.requests",
+			Dimensions: statusDims,
+			StatType:   statTypeCounter,
+			RuleName:   "global-http-request-count",
+		},
+	}
+	if status >= 400 {
+		routes = append(routes, decode.AlertRoute{
+			Series:     "http.errors",
+			Dimensions: statusDims,
+			StatType:   statTypeCounter,
+			RuleName:   "global-http-error-count",
+		})
+	}
+	if hasLatency {
+		(*fields)["http_latency_millis"] = millis
+		(*fields)["http_latency_bucket"] = httpLatencyBucket(millis)
+		routes = append(routes,
+			decode.AlertRoute{
+				Series:     "http.request-millis",
+				Dimensions: dims,
+				StatType:   statTypeGauge,
+				ValueField: "http_latency_millis",
+				RuleName:   "global-http-request-latency-gauge",
+			},
+			decode.AlertRoute{
+				Series:     "http.request-latency",
+				Dimensions: append(append([]string{}, dims...), "http_latency_bucket"),
+				StatType:   statTypeCounter,
+				RuleName:   "global-http-request-latency-buckets",
+			},
+		)
+	}
+	return routes
+}
+
+// httpRoute templates a request path so that it has low cardinality, e.g.
+// "/v3.0/students/5a15d5f70c3828572b00001d/contacts?limit=10" => "/v3.0/students/:id/contacts"
+func httpRoute(path string) string {
+	if idx := strings.IndexAny(path, "?#"); idx != -1 {
+		path = path[:idx]
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) == 1 && segments[0] == "" {
+		return "/"
+	}
+
+	truncated := len(segments) > maxRouteSegments
+	if truncated {
+		segments = segments[:maxRouteSegments]
+	}
+	for i, segment := range segments {
+		if reRouteID.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	route := "/" + strings.Join(segments, "/")
+	if truncated {
+		route += "/*"
+	}
+	return route
+}
+
+// httpLatencyBucket returns the http.request-latency bucket of a request, e.g. 120 => "le_250ms"
+func httpLatencyBucket(millis float64) string {
+	for _, bound := range httpLatencyBuckets {
+		if millis <= bound {
+			return fmt.Sprintf("le_%.0fms", bound)
+		}
+	}
+	return fmt.Sprintf("gt_%.0fms", httpLatencyBuckets[len(httpLatencyBuckets)-1])
 }
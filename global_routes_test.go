@@ -189,14 +189,129 @@ func TestMongoSlowQueries(t *testing.T) {
 	}
 }
 
+func TestMongoStructuredSlowQueries(t *testing.T) {
+	tests := []struct {
+		name       string
+		rawlog     string
+		operation  string
+		namespace  string
+		isCollscan bool
+		millis     float64
+		plan       string
+		appName    string
+		isNotMatch bool
+	}{
+		{
+			name:       "find with a collection scan",
+			rawlog:     `{"t":{"$date":"2021-06-01T10:00:00.000+00:00"},"s":"I","c":"COMMAND","id":51803,"ctx":"conn2852884","msg":"Slow query","attr":{"type":"command","ns":"clever.students","appName":"district-sync","command":{"find":"students","filter":{"district":{"$oid":"527bac1858c5a34a0c0000d0"}},"$db":"clever"},"planSummary":"COLLSCAN","keysExamined":0,"docsExamined":320707,"cursorExhausted":true,"numYields":2506,"nreturned":100,"reslen":75755,"protocol":"op_msg","durationMillis":1729}}`,
+			operation:  "command",
+			namespace:  "clever.students",
+			isCollscan: true,
+			millis:     1729,
+			plan:       "COLLSCAN",
+			appName:    "district-sync",
+		},
+		{
+			name:       "update using an index, without an app name",
+			rawlog:     `{"t":{"$date":"2021-06-01T10:00:00.000+00:00"},"s":"I","c":"WRITE","id":51803,"ctx":"conn18124","msg":"Slow query","attr":{"type":"update","ns":"clever.studentcontacts","command":{"q":{"_id":{"$oid":"5a15d5f70c3828572b00001d"}}},"planSummary":"IDHACK","keysExamined":1,"docsExamined":1,"nMatched":1,"nModified":1,"numYields":1,"durationMillis":11906}}`,
+			operation:  "update",
+			namespace:  "clever.studentcontacts",
+			isCollscan: false,
+			millis:     11906,
+			plan:       "IDHACK",
+		},
+		{
+			name:       "index scan plan summary is reduced to the plan",
+			rawlog:     `{"t":{"$date":"2021-06-01T10:00:00.000+00:00"},"s":"I","c":"COMMAND","id":51803,"ctx":"conn5261282","msg":"Slow query","attr":{"type":"command","ns":"archive.archive.sections","command":{"getMore":136494780397,"collection":"archive.sections"},"planSummary":"IXSCAN { _id: 1 }","durationMillis":112}}`,
+			operation:  "command",
+			namespace:  "archive.archive.sections",
+			isCollscan: false,
+			millis:     112,
+			plan:       "IXSCAN",
+		},
+		{
+			name:       "whitespace plan summary",
+			rawlog:     `{"t":{"$date":"2021-06-01T10:00:00.000+00:00"},"s":"I","c":"COMMAND","id":51803,"ctx":"conn1","msg":"Slow query","attr":{"type":"command","ns":"clever.students","planSummary":"  ","durationMillis":150}}`,
+			operation:  "command",
+			namespace:  "clever.students",
+			isCollscan: false,
+			millis:     150,
+			plan:       "NONE",
+		},
+		{
+			name:       "other structured log",
+			rawlog:     `{"t":{"$date":"2021-06-01T10:00:00.000+00:00"},"s":"I","c":"NETWORK","id":22943,"ctx":"listener","msg":"Connection accepted","attr":{"remote":"10.0.0.1:51234","connectionCount":12}}`,
+			isNotMatch: true,
+		},
+		{
+			name:       "slow query without a duration",
+			rawlog:     `{"t":{"$date":"2021-06-01T10:00:00.000+00:00"},"s":"I","c":"COMMAND","id":51803,"ctx":"conn1","msg":"Slow query","attr":{"type":"command","ns":"clever.students"}}`,
+			isNotMatch: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			fields := map[string]interface{}{"rawlog": test.rawlog}
+			routes := mongoSlowQueries(&fields)
+
+			if test.isNotMatch {
+				assert.Len(routes, 0)
+				assert.Len(fields, 1)
+				return
+			}
+
+			expectedDims := []string{"hostname", "operation", "namespace", "is_collscan", "plan", "app_name"}
+			if assert.Len(routes, 2) {
+				assert.Equal("mongo.slow-query", routes[0].Series)
+				assert.Equal(expectedDims, routes[0].Dimensions)
+				assert.Equal(statTypeCounter, routes[0].StatType)
+				assert.Equal("mongo.slow-query-millis", routes[1].Series)
+				assert.Equal(expectedDims, routes[1].Dimensions)
+				assert.Equal(statTypeGauge, routes[1].StatType)
+				assert.Equal("millis", routes[1].ValueField)
+			}
+
+			assert.Equal(test.operation, fields["operation"])
+			assert.Equal(test.namespace, fields["namespace"])
+			assert.Equal(test.millis, fields["millis"])
+			assert.Equal(test.isCollscan, fields["is_collscan"])
+			assert.Equal(test.plan, fields["plan"])
+			if test.appName != "" {
+				assert.Equal(test.appName, fields["app_name"])
+			} else {
+				assert.NotContains(fields, "app_name")
+			}
+		})
+	}
+}
+
 func Test_rdsSlowQueries(t *testing.T) {
+	rdsDims := []string{"env", "programname", "db_engine", "db_name", "db_user", "statement"}
+	countRoute := decode.AlertRoute{
+		Series:     "rds.slow-query",
+		Dimensions: rdsDims,
+		StatType:   statTypeCounter,
+		ValueField: defaultValueField,
+		RuleName:   "global-rds-slow-query-count",
+	}
+	gaugeRoute := decode.AlertRoute{
+		Series:     "rds.slow-query-millis",
+		Dimensions: rdsDims,
+		StatType:   statTypeGauge,
+		ValueField: "query_millis",
+		RuleName:   "global-rds-slow-query-gauge",
+	}
+
 	type args struct {
 		fields map[string]interface{}
 	}
 	tests := []struct {
-		name string
-		args args
-		want []decode.AlertRoute
+		name       string
+		args       args
+		want       []decode.AlertRoute
+		wantFields map[string]interface{}
 	}{
 		{
 			name: "Base case: doesn't route empty log",
@@ -233,22 +348,437 @@ func Test_rdsSlowQueries(t *testing.T) {
 					"user":     "clever[clever]",
 				},
 			},
-			want: []decode.AlertRoute{
-				{
-					Series:     "rds.slow-query",
-					Dimensions: []string{"env", "programname"},
-					StatType:   statTypeCounter,
-					ValueField: defaultValueField,
-					RuleName:   "global-rds-slow-query-count",
+			want: []decode.AlertRoute{countRoute, gaugeRoute},
+			wantFields: map[string]interface{}{
+				"db_engine":    "mysql",
+				"db_user":      "clever",
+				"query_millis": 882.22,
+				"statement":    "INSERT",
+			},
+		},
+		{
+			name: "MySQL log with a database",
+			args: args{
+				fields: map[string]interface{}{
+					"rawlog":   "# Time: 2021-06-01T10:00:00.000000Z\n# User@Host: app[app] @  [10.0.0.1]  Id: 42\n# Query_time: 2.500000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 200000\nuse districts;\nSET timestamp=1622541600;\nselect count(*) from schools where district_id = 'abc';",
+					"hostname": "aws-rds",
+					"user":     "app[app]",
+				},
+			},
+			want: []decode.AlertRoute{countRoute, gaugeRoute},
+			wantFields: map[string]interface{}{
+				"db_engine":    "mysql",
+				"db_name":      "districts",
+				"db_user":      "app",
+				"query_millis": float64(2500),
+				"statement":    "SELECT",
+			},
+		},
+		{
+			name: "PostgreSQL slow statement",
+			args: args{
+				fields: map[string]interface{}{
+					"rawlog":   "2021-06-01 10:00:00 UTC:10.0.0.1(51234):clever@districts:[1234]:LOG:  duration: 1500.125 ms  statement: UPDATE schools SET name = $1 WHERE id = $2",
+					"hostname": "aws-rds",
+				},
+			},
+			want: []decode.AlertRoute{countRoute, gaugeRoute},
+			wantFields: map[string]interface{}{
+				"db_engine":    "postgres",
+				"db_name":      "districts",
+				"db_user":      "clever",
+				"query_millis": 1500.125,
+				"statement":    "UPDATE",
+			},
+		},
+		{
+			name: "PostgreSQL slow prepared statement",
+			args: args{
+				fields: map[string]interface{}{
+					"rawlog":   "2021-06-01 10:00:00 UTC:10.0.0.1(51234):clever@districts:[1234]:LOG:  duration: 812.5 ms  execute <unnamed>: WITH s AS (SELECT 1) SELECT * FROM s",
+					"hostname": "aws-rds",
 				},
 			},
+			want: []decode.AlertRoute{countRoute, gaugeRoute},
+			wantFields: map[string]interface{}{
+				"db_engine":    "postgres",
+				"db_name":      "districts",
+				"db_user":      "clever",
+				"query_millis": 812.5,
+				"statement":    "WITH",
+			},
+		},
+		{
+			name: "PostgreSQL log that isn't a slow statement isn't routed as MySQL",
+			args: args{
+				fields: map[string]interface{}{
+					"rawlog":   "2021-06-01 10:00:00 UTC:10.0.0.1(51234):clever@districts:[1234]:LOG:  connection authorized: user=clever database=districts",
+					"hostname": "aws-rds",
+					"user":     "clever",
+				},
+			},
+			want: []decode.AlertRoute{},
+		},
+		{
+			name: "PostgreSQL slowquery by rdsadmin isn't routed",
+			args: args{
+				fields: map[string]interface{}{
+					"rawlog":   "2021-06-01 10:00:00 UTC:[local]:rdsadmin@rdsadmin:[99]:LOG:  duration: 1500.125 ms  statement: SELECT 1",
+					"hostname": "aws-rds",
+				},
+			},
+			want: []decode.AlertRoute{},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := rdsSlowQueries(tt.args.fields); !reflect.DeepEqual(got, tt.want) {
+			if got := rdsSlowQueries(&tt.args.fields); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("rdsSlowQueries() = %v, want %v", got, tt.want)
 			}
+			for k, v := range tt.wantFields {
+				assert.Equal(t, v, tt.args.fields[k], k)
+			}
+		})
+	}
+}
+
+func TestCrashes(t *testing.T) {
+	tests := []struct {
+		name       string
+		rawlog     string
+		runtime    string
+		errorClass string
+	}{
+		{
+			name:       "go nil pointer",
+			rawlog:     "panic: runtime error: invalid memory address or nil pointer dereference",
+			runtime:    "go",
+			errorClass: "runtime error: invalid memory address or nil pointer dereference",
+		},
+		{
+			name:       "go index out of range",
+			rawlog:     "panic: runtime error: index out of range [5] with length 3\n\ngoroutine 1 [running]:\nmain.main()",
+			runtime:    "go",
+			errorClass: "runtime error: index out of range",
+		},
+		{
+			name:       "go recovered and re-panicked",
+			rawlog:     `panic: could not load district "abc123" after 3 attempts [recovered]`,
+			runtime:    "go",
+			errorClass: "could not load district * after N attempts",
+		},
+		{
+			name:       "go fatal error",
+			rawlog:     "fatal error: concurrent map writes",
+			runtime:    "go",
+			errorClass: "concurrent map writes",
+		},
+		{
+			name:       "node uncaught",
+			rawlog:     "Uncaught TypeError: Cannot read property 'id' of undefined",
+			runtime:    "node",
+			errorClass: "TypeError",
+		},
+		{
+			name:       "node uncaught exception handler",
+			rawlog:     "Uncaught Exception: SyntaxError: Unexpected token < in JSON at position 0",
+			runtime:    "node",
+			errorClass: "SyntaxError",
+		},
+		{
+			name:       "node unhandled rejection warning",
+			rawlog:     "(node:1) UnhandledPromiseRejectionWarning: MongoNetworkError: failed to connect to server",
+			runtime:    "node",
+			errorClass: "MongoNetworkError",
+		},
+		{
+			name:       "node unhandled rejection warning on its own line",
+			rawlog:     "UnhandledPromiseRejectionWarning: MongoNetworkError: failed to connect to server",
+			runtime:    "node",
+			errorClass: "MongoNetworkError",
+		},
+		{
+			name:       "node thrown error",
+			rawlog:     "/app/server.js:10\n    throw new RangeError('bad');\n    ^\n\nRangeError: bad\n    at Object.<anonymous> (/app/server.js:10:11)",
+			runtime:    "node",
+			errorClass: "RangeError",
+		},
+		{
+			name:       "node unhandled rejection",
+			rawlog:     "[UnhandledPromiseRejection: This error originated either by throwing inside of an async function without a catch block]",
+			runtime:    "node",
+			errorClass: "UnhandledPromiseRejection",
+		},
+		{
+			name:   "kayvee log mentioning a panic",
+			rawlog: `{"title":"request-failed","error":"panic: oops"}`,
+		},
+		{
+			name:   "not a crash",
+			rawlog: "hello hello hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]interface{}{"rawlog": tt.rawlog}
+			routes := crashes(&fields)
+
+			if tt.runtime == "" {
+				assert.Len(t, routes, 0)
+				assert.Len(t, fields, 1)
+				return
+			}
+
+			assert.Equal(t, []decode.AlertRoute{{
+				Series:     "crash",
+				Dimensions: []string{"container_app", "container_env", "crash_runtime", "error_class"},
+				StatType:   statTypeCounter,
+				RuleName:   "global-crash-count",
+			}}, routes)
+			assert.Equal(t, tt.runtime, fields["crash_runtime"])
+			assert.Equal(t, tt.errorClass, fields["error_class"])
+		})
+	}
+}
+
+func TestContainerStops(t *testing.T) {
+	const programname = "production--my-app/arn%3Aaws%3Aecs%3Aus-west-2%3A589690932525%3Atask%2Fbe5eafc1-8e44-489a-8942-aaaaaaaaaaaa"
+
+	tests := []struct {
+		name       string
+		fields     map[string]interface{}
+		wantSeries string
+		wantFields map[string]interface{}
+	}{
+		{
+			name: "kernel cgroup oom kill",
+			fields: map[string]interface{}{
+				"rawlog":   "Memory cgroup out of memory: Killed process 31337 (node) total-vm:1620348kB, anon-rss:1020460kB, file-rss:0kB",
+				"hostname": "ip-10-0-0-1.us-west-2.compute.internal",
+			},
+			wantSeries: "ContainerOOMKillCount",
+			wantFields: map[string]interface{}{"oom_source": "kernel", "oom_process": "node", "oom_app": "node", "region": "us-west-2"},
+		},
+		{
+			name: "oom kill logged by an ecs task",
+			fields: map[string]interface{}{
+				"rawlog":        "Memory cgroup out of memory: Killed process 31337 (node) total-vm:1620348kB",
+				"programname":   programname,
+				"container_app": "my-app",
+			},
+			wantSeries: "ContainerOOMKillCount",
+			wantFields: map[string]interface{}{"oom_source": "kernel", "oom_process": "node", "oom_app": "my-app", "region": "us-west-2"},
+		},
+		{
+			name: "kernel system oom kill",
+			fields: map[string]interface{}{
+				"rawlog": "Out of memory: Kill process 4242 (java) score 900 or sacrifice child",
+			},
+			wantSeries: "ContainerOOMKillCount",
+			wantFields: map[string]interface{}{"oom_source": "kernel", "oom_process": "java", "oom_app": "java"},
+		},
+		{
+			name: "docker oom event",
+			fields: map[string]interface{}{
+				"rawlog":   "2021-06-01T10:00:00.000000000Z container oom 7805c1d35632 (image=my-app:latest, name=my-app)",
+				"hostname": "ip-10-0-0-1.ec2.internal",
+			},
+			wantSeries: "ContainerOOMKillCount",
+			wantFields: map[string]interface{}{"oom_source": "docker", "oom_app": "my-app", "region": "us-east-1"},
+		},
+		{
+			name: "docker oom event without a name",
+			fields: map[string]interface{}{
+				"rawlog":   "2021-06-01T10:00:00.000000000Z container oom 7805c1d35632 (image=my-app:latest)",
+				"hostname": "my-laptop",
+			},
+			wantSeries: "ContainerOOMKillCount",
+			wantFields: map[string]interface{}{"oom_source": "docker", "oom_app": "unknown"},
+		},
+		{
+			name: "docker die event",
+			fields: map[string]interface{}{
+				"rawlog":      "2021-06-01T10:00:00.000000000Z container die 7805c1d35632 (exitCode=137, image=my-app:latest, name=my-app)",
+				"programname": programname,
+			},
+			wantSeries: "ContainerExitCodeCount",
+			wantFields: map[string]interface{}{"exit_code": "137", "region": "us-west-2"},
+		},
+		{
+			name: "ecs agent container exit keeps existing region",
+			fields: map[string]interface{}{
+				"rawlog":      "Task engine [arn:aws:ecs:us-west-2:589690932525:task/abc]: container [name=app] stopped, exited with code 1",
+				"programname": programname,
+				"pod-region":  "us-east-1",
+			},
+			wantSeries: "ContainerExitCodeCount",
+			wantFields: map[string]interface{}{"exit_code": "1"},
+		},
+		{
+			name:   "not a container stop",
+			fields: map[string]interface{}{"rawlog": "container started"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]interface{}{}
+			for k, v := range tt.fields {
+				before[k] = v
+			}
+			routes := containerStops(&tt.fields)
+
+			if tt.wantSeries == "" {
+				assert.Len(t, routes, 0)
+				assert.Equal(t, before, tt.fields)
+				return
+			}
+
+			if assert.Len(t, routes, 1) {
+				assert.Equal(t, tt.wantSeries, routes[0].Series)
+				assert.Equal(t, statTypeCounter, routes[0].StatType)
+				_, allowed := cloudwatchAllowList[routes[0].Series]
+				assert.True(t, allowed)
+			}
+			for k, v := range tt.wantFields {
+				assert.Equal(t, v, tt.fields[k], k)
+			}
+			assert.Len(t, tt.fields, len(before)+len(tt.wantFields))
+		})
+	}
+}
+
+func TestHTTPAccessLogs(t *testing.T) {
+	tests := []struct {
+		name       string
+		fields     map[string]interface{}
+		wantSeries []string
+		wantFields map[string]interface{}
+	}{
+		{
+			name: "combined log format with request time",
+			fields: map[string]interface{}{
+				"rawlog": `10.0.0.1 - - [01/Jun/2021:10:00:00 +0000] "GET /v3.0/students/5a15d5f70c3828572b00001d/contacts?limit=10 HTTP/1.1" 200 512 "-" "curl/7.64.1" 0.153`,
+			},
+			wantSeries: []string{"http.requests", "http.request-millis", "http.request-latency"},
+			wantFields: map[string]interface{}{
+				"http_method":         "GET",
+				"http_route":          "/v3.0/students/:id/contacts",
+				"http_status_class":   "2xx",
+				"http_latency_millis": 153.0,
+				"http_latency_bucket": "le_250ms",
+			},
+		},
+		{
+			name: "common log format without request time",
+			fields: map[string]interface{}{
+				"rawlog": `10.0.0.1 - frank [01/Jun/2021:10:00:00 +0000] "POST /sections/42 HTTP/1.0" 503 -`,
+			},
+			wantSeries: []string{"http.requests", "http.errors"},
+			wantFields: map[string]interface{}{
+				"http_method":       "POST",
+				"http_route":        "/sections/:id",
+				"http_status_class": "5xx",
+			},
+		},
+		{
+			name: "alb access log",
+			fields: map[string]interface{}{
+				"rawlog": `https 2021-06-01T10:00:00.186641Z app/my-lb/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.001 0.400 0.001 404 404 34 366 "GET https://api.clever.com:443/users/8a8c3b6e-2d3f-4b4a-9f7e-0c1d2e3f4a5b HTTP/1.1" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-west-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2021-06-01T10:00:00.186000Z "forward" "-" "-" "10.0.0.1:80" "404" "-" "-"`,
+			},
+			wantSeries: []string{"http.requests", "http.errors", "http.request-millis", "http.request-latency"},
+			wantFields: map[string]interface{}{
+				"load_balancer":       "app/my-lb/50dc6c495c0c9188",
+				"http_method":         "GET",
+				"http_route":          "/users/:id",
+				"http_status_class":   "4xx",
+				"http_latency_millis": 402.0,
+				"http_latency_bucket": "le_500ms",
+			},
+		},
+		{
+			name: "alb access log for an unreachable target",
+			fields: map[string]interface{}{
+				"rawlog": `http 2021-06-01T10:00:00.186641Z app/my-lb/50dc6c495c0c9188 192.168.131.39:2817 - -1 -1 -1 502 - 34 366 "GET http://api.clever.com:80/ HTTP/1.1" "curl/7.46.0" - - - "-" "-" "-"`,
+			},
+			wantSeries: []string{"http.requests", "http.errors"},
+			wantFields: map[string]interface{}{
+				"load_balancer":     "app/my-lb/50dc6c495c0c9188",
+				"http_method":       "GET",
+				"http_route":        "/",
+				"http_status_class": "5xx",
+			},
+		},
+		{
+			name: "kayvee request-finished uses the wag operation",
+			fields: map[string]interface{}{
+				"title":            "request-finished",
+				"method":           "GET",
+				"path":             "/students/1234",
+				"op":               "getStudent",
+				"status-code":      200.0,
+				"response-time-ms": 12.0,
+			},
+			wantSeries: []string{"http.requests", "http.request-millis", "http.request-latency"},
+			wantFields: map[string]interface{}{
+				"http_method":         "GET",
+				"http_route":          "getStudent",
+				"http_status_class":   "2xx",
+				"http_latency_millis": 12.0,
+				"http_latency_bucket": "le_25ms",
+			},
+		},
+		{
+			name: "kayvee request-finished without a status",
+			fields: map[string]interface{}{
+				"title":  "request-finished",
+				"method": "GET",
+				"path":   "/students/1234",
+			},
+		},
+		{
+			name:   "not an access log",
+			fields: map[string]interface{}{"rawlog": "GET /students/1234 took 5ms"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]interface{}{}
+			for k, v := range tt.fields {
+				before[k] = v
+			}
+			routes := httpAccessLogs(&tt.fields)
+
+			series := []string{}
+			for _, route := range routes {
+				series = append(series, route.Series)
+			}
+			assert.Equal(t, append([]string{}, tt.wantSeries...), series)
+
+			for k, v := range tt.wantFields {
+				assert.Equal(t, v, tt.fields[k], k)
+			}
+			assert.Len(t, tt.fields, len(before)+len(tt.wantFields))
 		})
 	}
 }
+
+func TestHTTPRoute(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/health?full=true", "/health"},
+		{"/students/123/", "/students/:id"},
+		{"/v3.0/districts/527bac1858c5a34a0c0000d0/students", "/v3.0/districts/:id/students"},
+		{"/files/tok_1a2b3c4d5e6f7g8h9i0j", "/files/:id"},
+		{"/a/b/c/d/e/f/g", "/a/b/c/d/e/*"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, httpRoute(tt.path), tt.path)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+)
+
+const (
+	// Why the points of a route were suppressed
+	routeSampled     = "sampled"
+	routeRateLimited = "rate_limited"
+)
+
+// routeLimitConfig samples and rate limits the points of an alert rule, or of every rule of a
+// series
+type routeLimitConfig struct {
+	// Exactly one of Rule and Series is set. Rule limits take precedence over series limits.
+	Rule   string `yaml:"rule"`
+	Series string `yaml:"series"`
+	// SampleRate is the share of logs whose points are emitted. Counters are divided by it, so
+	// that their totals stay the same. Defaults to 1.
+	SampleRate float64 `yaml:"sample_rate"`
+	// MaxPointsPerSecond is the rate of points a rule may emit. Zero means no limit.
+	MaxPointsPerSecond float64 `yaml:"max_points_per_second"`
+	// Burst is how many points a rule may emit at once. Defaults to a second of points.
+	Burst float64 `yaml:"burst"`
+}
+
+func (c routeLimitConfig) withDefaults() routeLimitConfig {
+	if c.SampleRate == 0 {
+		c.SampleRate = 1
+	}
+	if c.Burst == 0 {
+		c.Burst = math.Max(1, c.MaxPointsPerSecond)
+	}
+	return c
+}
+
+// name identifies the limit in errors, e.g. "rule/login-count"
+func (c routeLimitConfig) name() string {
+	if c.Rule != "" {
+		return "rule/" + c.Rule
+	}
+	return "series/" + c.Series
+}
+
+func (c routeLimitConfig) validate() error {
+	if (c.Rule == "") == (c.Series == "") {
+		return fmt.Errorf("route limit must have exactly one of rule and series")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("route limit %s has invalid sample_rate %v, must be in (0, 1]", c.name(), c.SampleRate)
+	}
+	if c.MaxPointsPerSecond < 0 || c.Burst < 0 {
+		return fmt.Errorf("route limit %s must have a positive max_points_per_second and burst", c.name())
+	}
+	c = c.withDefaults()
+	if c.SampleRate == 1 && c.MaxPointsPerSecond == 0 {
+		return fmt.Errorf("route limit %s must have a sample_rate or max_points_per_second", c.name())
+	}
+	return nil
+}
+
+// tokenBucket holds the points a rule may emit. It refills at a constant rate up to its burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens from the bucket, and returns false if it doesn't hold them
+func (b *tokenBucket) take(now time.Time, n, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// routeLimit is a configured limit, with a token bucket for every rule it applies to
+type routeLimit struct {
+	config routeLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// routeLimiter samples and rate limits the points of alert routes.
+//
+// A nil *routeLimiter doesn't limit any route.
+type routeLimiter struct {
+	byRule   map[string]*routeLimit
+	bySeries map[string]*routeLimit
+
+	now    func() time.Time
+	sample func() float64
+}
+
+func newRouteLimiter(configs []routeLimitConfig) *routeLimiter {
+	l := &routeLimiter{
+		byRule:   map[string]*routeLimit{},
+		bySeries: map[string]*routeLimit{},
+		now:      time.Now,
+		sample:   rand.Float64,
+	}
+	for _, config := range configs {
+		limit := &routeLimit{config: config.withDefaults(), buckets: map[string]*tokenBucket{}}
+		if config.Rule != "" {
+			l.byRule[config.Rule] = limit
+		} else {
+			l.bySeries[config.Series] = limit
+		}
+	}
+	return l
+}
+
+// limit returns the limit of a route, if it has one
+func (l *routeLimiter) limit(route decode.AlertRoute) (*routeLimit, bool) {
+	if l == nil {
+		return nil, false
+	}
+	limit, ok := l.byRule[route.RuleName]
+	if !ok {
+		limit, ok = l.bySeries[route.Series]
+	}
+	return limit, ok
+}
+
+// allow decides whether a route emits its points for a log. It returns the sample rate the
+// route's counters are divided by, or why its points are suppressed.
+func (l *routeLimiter) allow(route decode.AlertRoute, points int) (float64, string) {
+	limit, ok := l.limit(route)
+	if !ok {
+		return 1, ""
+	}
+
+	// Logs that are sampled out don't use up the rate limit
+	if limit.config.SampleRate < 1 && l.sample() >= limit.config.SampleRate {
+		return 0, routeSampled
+	}
+	if limit.config.MaxPointsPerSecond > 0 {
+		limit.mu.Lock()
+		defer limit.mu.Unlock()
+		bucket, ok := limit.buckets[route.RuleName]
+		if !ok {
+			bucket = &tokenBucket{}
+			limit.buckets[route.RuleName] = bucket
+		}
+		if !bucket.take(l.now(), float64(points), limit.config.MaxPointsPerSecond, limit.config.Burst) {
+			return 0, routeRateLimited
+		}
+	}
+	return limit.config.SampleRate, ""
+}
+
+// refund gives back the tokens of points that a route was allowed but didn't emit, e.g. because
+// their values were the wrong type, so that they don't get later points rate limited
+func (l *routeLimiter) refund(route decode.AlertRoute, points int) {
+	limit, ok := l.limit(route)
+	if !ok || points <= 0 || limit.config.MaxPointsPerSecond == 0 {
+		return
+	}
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	if bucket, ok := limit.buckets[route.RuleName]; ok {
+		bucket.tokens = math.Min(limit.config.Burst, bucket.tokens+float64(points))
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	b := &tokenBucket{}
+
+	// Starts full
+	assert.True(t, b.take(now, 2, 1, 3))
+	assert.True(t, b.take(now, 1, 1, 3))
+	assert.False(t, b.take(now, 1, 1, 3))
+
+	// Refills at the rate
+	assert.False(t, b.take(now.Add(500*time.Millisecond), 1, 1, 3))
+	assert.True(t, b.take(now.Add(time.Second), 1, 1, 3))
+
+	// Up to the burst
+	assert.False(t, b.take(now.Add(time.Hour), 4, 1, 3))
+	assert.True(t, b.take(now.Add(time.Hour), 3, 1, 3))
+}
+
+func TestRouteLimiter(t *testing.T) {
+	limiter := newRouteLimiter([]routeLimitConfig{
+		{Rule: "sampled-rule", SampleRate: 0.25},
+		{Series: "limited", MaxPointsPerSecond: 2},
+	})
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	samples := []float64{0.1, 0.3}
+	limiter.sample = func() float64 {
+		s := samples[0]
+		samples = samples[1:]
+		return s
+	}
+
+	allow := func(rule, series string, points int) (float64, string) {
+		return limiter.allow(decode.AlertRoute{RuleName: rule, Series: series}, points)
+	}
+
+	rate, suppressed := allow("sampled-rule", "any", 1)
+	assert.Equal(t, 0.25, rate)
+	assert.Equal(t, "", suppressed)
+	_, suppressed = allow("sampled-rule", "any", 1)
+	assert.Equal(t, routeSampled, suppressed)
+
+	// Every rule of a series has its own bucket
+	rate, suppressed = allow("rule-a", "limited", 2)
+	assert.Equal(t, 1.0, rate)
+	assert.Equal(t, "", suppressed)
+	_, suppressed = allow("rule-a", "limited", 1)
+	assert.Equal(t, routeRateLimited, suppressed)
+	_, suppressed = allow("rule-b", "limited", 1)
+	assert.Equal(t, "", suppressed)
+	now = now.Add(time.Second)
+	_, suppressed = allow("rule-a", "limited", 2)
+	assert.Equal(t, "", suppressed)
+
+	rate, suppressed = allow("other-rule", "other", 1)
+	assert.Equal(t, 1.0, rate)
+	assert.Equal(t, "", suppressed)
+
+	var none *routeLimiter
+	rate, suppressed = none.allow(decode.AlertRoute{RuleName: "sampled-rule"}, 1)
+	assert.Equal(t, 1.0, rate)
+	assert.Equal(t, "", suppressed)
+}
+
+func TestEncodeMessageLimitsRoutes(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableRouteLimits([]routeLimitConfig{
+		{Rule: "login-rule", SampleRate: 0.25},
+		{Rule: "logout-rule", MaxPointsPerSecond: 1},
+	})
+	consumer.limits.sample = func() float64 { return 0.1 }
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	consumer.limits.now = func() time.Time { return now }
+
+	collectMetrics()
+	input := seriesTestInput("login", "logout")
+	input["container_env"] = "production"
+	input["container_app"] = "my-app"
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 2)
+	// Counters are upscaled by the sample rate
+	assert.Equal(t, 4.0, *eo.DDMetrics[0].Points[0].Value)
+	assert.Equal(t, 1.0, *eo.DDMetrics[1].Points[0].Value)
+
+	input = seriesTestInput("login", "logout")
+	input["container_env"] = "production"
+	input["container_app"] = "my-app"
+	output, _, err = consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo = EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 1)
+	assert.Equal(t, "kv.login", eo.DDMetrics[0].Metric)
+
+	routes := collectMetrics().logRouteVolumes
+	assert.Equal(t, 1, routes[logRoute{"my-app", "production", "logout-rule", routeRateLimited}])
+	assert.Equal(t, 2, routes[logRoute{"my-app", "production", "logout-rule", ""}])
+}
+
+func TestEncodeMessageRefundsFailedPoints(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableRouteLimits([]routeLimitConfig{{Rule: "batch-rule", MaxPointsPerSecond: 1, Burst: 2}})
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	consumer.limits.now = func() time.Time { return now }
+
+	input := func(values ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"batch":     values,
+			"Hostname":  "my-hostname",
+			"timestamp": time.Unix(0, 0),
+			"_kvmeta": map[string]interface{}{
+				"team": "eng-team",
+				"routes": []interface{}{map[string]interface{}{
+					"type":        "alerts",
+					"series":      "batch",
+					"dimensions":  []interface{}{},
+					"stat_type":   "gauge",
+					"value_field": "batch",
+					"rule":        "batch-rule",
+				}},
+			},
+		}
+	}
+
+	// One of the two points allowed fails, so its token is given back
+	output, _, err := consumer.encodeMessage(input(float64(1), "invalid"), 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	assert.Len(t, eo.DDMetrics, 1)
+
+	output, _, err = consumer.encodeMessage(input(float64(2)), 0)
+	require.NoError(t, err)
+	eo = EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	assert.Len(t, eo.DDMetrics, 1)
+
+	_, _, err = consumer.encodeMessage(input(float64(3)), 0)
+	assert.Equal(t, kbc.ErrMessageIgnored, err)
+}
+
+func TestRouteLimitConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "sampled rule",
+			config: routeLimitConfig{Rule: "login-rule", SampleRate: 0.1},
+		},
+		{
+			name:   "rate limited series",
+			config: routeLimitConfig{Series: "login", MaxPointsPerSecond: 100, Burst: 1000},
+		},
+		{
+			name:    "rule and series",
+			config:  routeLimitConfig{Rule: "login-rule", Series: "login", SampleRate: 0.1},
+			wantErr: "exactly one of rule and series",
+		},
+		{
+			name:    "invalid sample rate",
+			config:  routeLimitConfig{Rule: "login-rule", SampleRate: 2},
+			wantErr: "invalid sample_rate 2",
+		},
+		{
+			name:    "negative rate",
+			config:  routeLimitConfig{Rule: "login-rule", MaxPointsPerSecond: -1},
+			wantErr: "must have a positive max_points_per_second and burst",
+		},
+		{
+			name:    "no limit",
+			config:  routeLimitConfig{Rule: "login-rule", SampleRate: 1},
+			wantErr: "must have a sample_rate or max_points_per_second",
+		},
+	})
+}
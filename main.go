@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
@@ -13,7 +15,6 @@ import (
 
 	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
 	"github.com/Clever/kayvee-go/v7/logger"
-	datadog "github.com/DataDog/datadog-api-client-go/api/v2/datadog"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/kardianos/osext"
@@ -48,8 +49,21 @@ func setupLogRouting() {
 	}
 }
 
+func loadConfig() consumerConfig {
+	dir, err := osext.ExecutableFolder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := loadConsumerConfig(path.Join(dir, "config.yml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
 func main() {
 	setupLogRouting()
+	consumerConfig := loadConfig()
 
 	config := kbc.Config{
 		FailedLogsFile: "/tmp/kinesis-consumer-" + time.Now().Format(time.RFC3339),
@@ -65,9 +79,48 @@ func main() {
 		"us-east-2": cloudwatch.New(session.New(&aws.Config{Region: aws.String("us-east-2")})),
 	}
 
-	ddAPIClient := datadog.NewAPIClient(datadog.NewConfiguration())
+	ddDefault, err := newDDClient(defaultDDDestination, "", consumerConfig.Datadog.ddSettings)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	ac := NewAlertsConsumer(ddAPIClient.MetricsApi, getEnv("DEPLOY_ENV"), cwAPIs)
+	ac := NewAlertsConsumer(ddDefault.api, getEnv("DEPLOY_ENV"), cwAPIs)
+	ac.addDDDestination(ddDefault, nil)
+	for _, dest := range consumerConfig.Datadog.Destinations {
+		dd, err := newDDClient(dest.Name, getEnv(dest.APIKeyEnv), dest.ddSettings.inherit(consumerConfig.Datadog.ddSettings))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ac.addDDDestination(dd, dest.Teams)
+	}
+	ac.enableCircuitBreakers(consumerConfig.CircuitBreaker)
+	if consumerConfig.LogLevels.Enabled {
+		ac.enableLogLevelMetrics(consumerConfig.LogLevels)
+	}
+	if pii := consumerConfig.PII; len(pii.Rules) > 0 {
+		hashKey := ""
+		if pii.HashKeyEnv != "" {
+			hashKey = getEnv(pii.HashKeyEnv)
+		}
+		ac.enablePIIScrubbing(pii, hashKey)
+	}
+	if len(consumerConfig.LogQuotas) > 0 {
+		ac.enableLogQuotas(consumerConfig.LogQuotas)
+	}
+	ac.enableSeriesMapping(consumerConfig.Series)
+	if len(consumerConfig.RouteLimits) > 0 {
+		ac.enableRouteLimits(consumerConfig.RouteLimits)
+	}
+	if len(consumerConfig.DimensionPolicies) > 0 {
+		ac.enableDimensionPolicies(consumerConfig.DimensionPolicies)
+	}
+	if len(consumerConfig.ValueCoercion) > 0 {
+		ac.enableValueCoercion(consumerConfig.ValueCoercion)
+	}
+	ac.limitRoutePoints(consumerConfig.RoutePoints)
+	if len(consumerConfig.MultiValueRoutes) > 0 {
+		ac.enableMultiValueRoutes(consumerConfig.MultiValueRoutes)
+	}
 
 	// Track Max Delay
 	go func() {
@@ -77,9 +130,27 @@ func main() {
 	}()
 
 	// Track Volume
+	configureTalkers(consumerConfig.TopTalkers)
+	configureSpikes(consumerConfig.VolumeSpikes)
+	if addr := consumerConfig.TopTalkers.DebugAddr; addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/top-talkers", topTalkersHandler)
+		// Every shard's process serves its own table. With a port of 0, e.g. ":0", each gets a free
+		// port; with a fixed one, only the first process binds it and the others go without.
+		if listener, err := net.Listen("tcp", addr); err != nil {
+			lg.ErrorD("top-talkers-debug-server", logger.M{"addr": addr, "error": err.Error()})
+		} else {
+			lg.InfoD("top-talkers-debug-server", logger.M{"addr": listener.Addr().String(), "consumer": consumerID})
+			go func() {
+				if err := http.Serve(listener, mux); err != nil {
+					lg.ErrorD("top-talkers-debug-server", logger.M{"addr": addr, "error": err.Error()})
+				}
+			}()
+		}
+	}
 	go func() {
 		tic := time.Tick(time.Minute)
-		processMetrics(ddAPIClient.MetricsApi, tic)
+		processMetrics(ddDefault, tic)
 	}()
 
 	consumer := kbc.NewBatchConsumer(config, ac)
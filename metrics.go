@@ -1,15 +1,19 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-api-client-go/api/v2/datadog"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/eapache/go-resiliency/retrier"
-	"golang.org/x/net/context"
 
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+	"github.com/Clever/amazon-kinesis-client-go/decode"
 	"github.com/Clever/kayvee-go/v7/logger"
 )
 
@@ -23,6 +27,9 @@ type logRoute struct {
 	app      string
 	env      string
 	ruleName string
+	// suppressed is why the route's points weren't emitted (routeSampled or routeRateLimited), or
+	// empty for a log that matched the route
+	suppressed string
 }
 
 type volume struct {
@@ -30,22 +37,224 @@ type volume struct {
 	size  int
 }
 
-type work struct {
-	eat  *envAppTeam
-	lr   *logRoute
-	size int
+// logLevel counts the logs of an app at one level, e.g. error
+type logLevel struct {
+	env   string
+	app   string
+	level string
+}
+
+// consumerID identifies this process in the metrics that it computes over only the logs of the
+// shards it consumes, e.g. quota usage, so that the metrics of every process are kept apart.
+// run_kcl.sh starts a process per shard.
+var consumerID = consumerName()
+
+// consumerName is the host and pid of the process, e.g. "ip-10-0-0-1/123"
+func consumerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + "/" + strconv.Itoa(os.Getpid())
+}
+
+// counterTagSeparator joins the tags of a counter. It can't be part of a tag, unlike a comma,
+// which rule names, series and dimension values may contain.
+const counterTagSeparator = "\x00"
+
+// counter is one of the consumer's own metrics, e.g. errors submitting to a sink
+type counter struct {
+	name string
+	// tags are joined by counterTagSeparator, since slices can't be used as map keys
+	tags string
+}
+
+func newCounter(name string, tags ...string) counter {
+	return counter{name, strings.Join(tags, counterTagSeparator)}
+}
+
+// tagList returns the tags of the counter
+func (c counter) tagList() []string {
+	if c.tags == "" {
+		return []string{}
+	}
+	return strings.Split(c.tags, counterTagSeparator)
+}
+
+// Outcomes of processing a log, for route accounting
+const (
+	routeOutcomeEmitted = "emitted"
+	routeOutcomeIgnored = "ignored"
+	routeOutcomeError   = "error"
+	// routeOutcomeDenied is a route whose series or dimensions aren't allowed
+	routeOutcomeDenied = "denied"
+	// routeOutcomeSuppressed is a route whose points were sampled away or rate limited
+	routeOutcomeSuppressed = "suppressed"
+
+	// noRoute is the route of logs that don't match any route
+	noRoute = "none"
+	// maxRouteSeries bounds how many distinct series are counted for a route in an interval
+	maxRouteSeries = 1000
+)
+
+// routeCostKey is a route of an app, and the outcome of the logs that matched it
+type routeCostKey struct {
+	env     string
+	app     string
+	team    string
+	rule    string
+	outcome string
+}
+
+// routeCost is what the logs matching a route cost over an interval
+type routeCost struct {
+	messages int
+	bytes    int
+	points   int
+	// series are the hashes of the distinct series emitted
+	series map[uint64]struct{}
+}
+
+func (rc routeCost) add(o routeCost) routeCost {
+	rc.messages += o.messages
+	rc.bytes += o.bytes
+	rc.points += o.points
+	if rc.series == nil {
+		rc.series = map[uint64]struct{}{}
+	}
+	for h := range o.series {
+		if len(rc.series) >= maxRouteSeries {
+			break
+		}
+		rc.series[h] = struct{}{}
+	}
+	return rc
+}
+
+// aggregates are the pipeline metrics recorded over an interval
+type aggregates struct {
+	envAppTeamVolumes map[envAppTeam]volume
+	logRouteVolumes   map[logRoute]int
+	logLevelVolumes   map[logLevel]int
+	counters          map[counter]int
+	routeCosts        map[routeCostKey]routeCost
+}
+
+func newAggregates() aggregates {
+	return aggregates{
+		envAppTeamVolumes: map[envAppTeam]volume{},
+		logRouteVolumes:   map[logRoute]int{},
+		logLevelVolumes:   map[logLevel]int{},
+		counters:          map[counter]int{},
+		routeCosts:        map[routeCostKey]routeCost{},
+	}
+}
+
+// merge adds the aggregates of o to a
+func (a aggregates) merge(o aggregates) {
+	for eat, vol := range o.envAppTeamVolumes {
+		v := a.envAppTeamVolumes[eat]
+		a.envAppTeamVolumes[eat] = volume{v.count + vol.count, v.size + vol.size}
+	}
+	for lr, n := range o.logRouteVolumes {
+		a.logRouteVolumes[lr] += n
+	}
+	for ll, n := range o.logLevelVolumes {
+		a.logLevelVolumes[ll] += n
+	}
+	for c, n := range o.counters {
+		a.counters[c] += n
+	}
+	for key, cost := range o.routeCosts {
+		a.routeCosts[key] = a.routeCosts[key].add(cost)
+	}
+}
+
+const (
+	metricsShards = 16
+	// maxShardKeys bounds how many series a shard aggregates in an interval. Metrics for new
+	// series past it are dropped, so memory stays bounded when something logs unbounded app
+	// names, routes or tags.
+	maxShardKeys = 10000
+)
+
+// metricsShard is one of the independently locked aggregates that metrics are recorded into.
+// Recording picks a shard that isn't locked, so concurrent ProcessMessage calls don't wait on
+// each other, and the shards are merged when the metrics are shipped.
+type metricsShard struct {
+	mu sync.Mutex
+	aggregates
+	keys int
+	// appTalkers track volume by env/app, and titleTalkers by source/title. They aren't reset by
+	// collectMetrics, but by flushTalkers, which merges them over the shards.
+	appTalkers   *spaceSaving
+	titleTalkers *spaceSaving
 }
 
 var (
-	envAppTeamVolumes = map[envAppTeam]volume{}
-	logRouteVolumes   = map[logRoute]int{}
-	retry             = retrier.New(retrier.ExponentialBackoff(5, 50*time.Millisecond), nil)
-	// 10000 is hopefully sufficiently large to prevent metrics recording from blocking
-	chMetrics = make(chan work, 10000)
+	shards    = newMetricsShards()
+	nextShard uint32
+	// droppedMetrics counts metrics that weren't recorded because their shard was full
+	droppedMetrics int64
 )
 
-// A thread safe way to record metrics pipeline metrics.
-func recordMetrics(env, app, team string, numBytes int, routeNames []string) {
+func newMetricsShards() []*metricsShard {
+	s := make([]*metricsShard, metricsShards)
+	for i := range s {
+		s[i] = &metricsShard{
+			aggregates:   newAggregates(),
+			appTalkers:   newSpaceSaving(talkersConfig{}.withDefaults().Capacity),
+			titleTalkers: newSpaceSaving(talkersConfig{}.withDefaults().Capacity),
+		}
+	}
+	return s
+}
+
+// lockShard returns a locked shard. Shards are tried round robin starting from a different one
+// on every call, and only if all of them are busy does it wait for one.
+func lockShard() *metricsShard {
+	start := atomic.AddUint32(&nextShard, 1)
+	for i := uint32(0); i < metricsShards; i++ {
+		s := shards[(start+i)%metricsShards]
+		if s.mu.TryLock() {
+			return s
+		}
+	}
+	s := shards[start%metricsShards]
+	s.mu.Lock()
+	return s
+}
+
+// hasRoom returns whether the shard can aggregate a new series, and counts a drop if it can't
+func (s *metricsShard) hasRoom(exists bool) bool {
+	if exists {
+		return true
+	}
+	if s.keys >= maxShardKeys {
+		atomic.AddInt64(&droppedMetrics, 1)
+		return false
+	}
+	s.keys++
+	return true
+}
+
+// collectMetrics returns the metrics recorded since it was last called
+func collectMetrics() aggregates {
+	collected := newAggregates()
+	for _, s := range shards {
+		s.mu.Lock()
+		a := s.aggregates
+		s.aggregates = newAggregates()
+		s.keys = 0
+		s.mu.Unlock()
+		collected.merge(a)
+	}
+	return collected
+}
+
+// A thread safe way to record metrics pipeline metrics. It never blocks on the shipping of
+// metrics. title identifies the kind of log, as source/title.
+func recordMetrics(env, app, team, title string, numBytes int, routeNames []string) {
 	if env == "" {
 		env = "unknown"
 	}
@@ -55,45 +264,165 @@ func recordMetrics(env, app, team string, numBytes int, routeNames []string) {
 	if team == "" {
 		team = "unknown"
 	}
-	chMetrics <- work{
-		eat:  &envAppTeam{env, app, team},
-		size: numBytes,
-	}
+	s := lockShard()
+	defer s.mu.Unlock()
 
+	s.appTalkers.add(env+"/"+app, int64(numBytes))
+	s.titleTalkers.add(title, int64(numBytes))
+
+	eat := envAppTeam{env, app, team}
+	vol, ok := s.envAppTeamVolumes[eat]
+	if s.hasRoom(ok) {
+		s.envAppTeamVolumes[eat] = volume{vol.count + 1, vol.size + numBytes}
+	}
 	for _, n := range routeNames {
-		chMetrics <- work{
-			lr: &logRoute{app, env, n},
+		lr := logRoute{app, env, n, ""}
+		count, ok := s.logRouteVolumes[lr]
+		if s.hasRoom(ok) {
+			s.logRouteVolumes[lr] = count + 1
 		}
 	}
 }
 
-// processMetrics aggregates all metrics sent over the channel by recordMetrics. On the interval of the ticker
-// the aggregates will be shipped to DD and reset. Process is not thread safe and should only be run by one
-// goroutine.
-func processMetrics(dd DDMetricsAPI, tic <-chan time.Time) {
-	for {
-		select {
-		case <-tic:
-			shipMetrics(dd)
-		case w := <-chMetrics:
-			if w.eat != nil {
-				vol := envAppTeamVolumes[*w.eat]
-				envAppTeamVolumes[*w.eat] = volume{vol.count + 1, vol.size + w.size}
-			}
-			if w.lr != nil {
-				n := logRouteVolumes[*w.lr]
-				logRouteVolumes[*w.lr] = n + 1
+// recordRouteSuppressed counts a log whose points for a route were suppressed, for reason
+func recordRouteSuppressed(env, app, ruleName, reason string) {
+	if env == "" {
+		env = "unknown"
+	}
+	if app == "" {
+		app = "unknown"
+	}
+
+	s := lockShard()
+	defer s.mu.Unlock()
+
+	lr := logRoute{app, env, ruleName, reason}
+	n, ok := s.logRouteVolumes[lr]
+	if s.hasRoom(ok) {
+		s.logRouteVolumes[lr] = n + 1
+	}
+}
+
+// recordLogLevel counts a log of app at level. Like recordMetrics, it's thread safe.
+func recordLogLevel(env, app, level string) {
+	if env == "" {
+		env = "unknown"
+	}
+	if app == "" {
+		app = "unknown"
+	}
+
+	s := lockShard()
+	defer s.mu.Unlock()
+
+	ll := logLevel{env, app, level}
+	n, ok := s.logLevelVolumes[ll]
+	if s.hasRoom(ok) {
+		s.logLevelVolumes[ll] = n + 1
+	}
+}
+
+// recordCounter adds n to the counter called name. Counters are shipped with the volume metrics
+// as kinesis_alerts_consumer.<name>.
+func recordCounter(name string, n int, tags ...string) {
+	s := lockShard()
+	defer s.mu.Unlock()
+
+	c := newCounter(name, tags...)
+	total, ok := s.counters[c]
+	if s.hasRoom(ok) {
+		s.counters[c] = total + n
+	}
+}
+
+// recordRouteCosts accounts for a log in the routes it matched, by the outcome of processing it.
+// series are the series emitted by each route, routeErrs the errors of each route, skipped the
+// outcome of each route that was denied or suppressed, and err is the error processing the log.
+// Routes that were skipped, or failed without emitting anything, don't take the log's outcome
+// even when its other routes were emitted.
+func recordRouteCosts(env, app, team string, routes []decode.AlertRoute, series [][]string, routeErrs []error, skipped []string, numBytes int, err error) {
+	if env == "" {
+		env = "unknown"
+	}
+	if app == "" {
+		app = "unknown"
+	}
+	if team == "" {
+		team = "unknown"
+	}
+	outcome := routeOutcomeEmitted
+	if err == kbc.ErrMessageIgnored {
+		outcome = routeOutcomeIgnored
+	} else if err != nil {
+		outcome = routeOutcomeError
+	}
+
+	costs := map[routeCostKey]routeCost{}
+	if len(routes) == 0 {
+		costs[routeCostKey{env, app, team, noRoute, outcome}] = routeCost{messages: 1, bytes: numBytes}
+	}
+	for idx, route := range routes {
+		routeOutcome := outcome
+		if skipped[idx] != "" {
+			routeOutcome = skipped[idx]
+		} else if outcome == routeOutcomeEmitted && routeErrs[idx] != nil && len(series[idx]) == 0 {
+			routeOutcome = routeOutcomeError
+		}
+		cost := routeCost{messages: 1, bytes: numBytes}
+		if routeOutcome == routeOutcomeEmitted {
+			cost.points = len(series[idx])
+			cost.series = map[uint64]struct{}{}
+			for _, s := range series[idx] {
+				h := fnv.New64a()
+				h.Write([]byte(s))
+				cost.series[h.Sum64()] = struct{}{}
 			}
 		}
+		key := routeCostKey{env, app, team, route.RuleName, routeOutcome}
+		costs[key] = costs[key].add(cost)
+	}
+
+	s := lockShard()
+	defer s.mu.Unlock()
+	for key, cost := range costs {
+		existing, ok := s.routeCosts[key]
+		if s.hasRoom(ok) {
+			s.routeCosts[key] = existing.add(cost)
+		}
+	}
+}
+
+// seriesID identifies a series by its metric and tags
+func seriesID(metric string, tags []string) string {
+	return metric + "|" + strings.Join(tags, ",")
+}
+
+// processMetrics ships the metrics recorded by recordMetrics to DD on the interval of the ticker.
+// It returns when tic is closed.
+func processMetrics(dd *ddClient, tic <-chan time.Time) {
+	for range tic {
+		shipMetrics(dd)
 	}
 }
 
-func shipMetrics(dd DDMetricsAPI) {
-	eatCopy := envAppTeamVolumes
-	envAppTeamVolumes = map[envAppTeam]volume{}
+func shipMetrics(dd *ddClient) {
+	collected := collectMetrics()
+	eatCopy := collected.envAppTeamVolumes
+	lrCopy := collected.logRouteVolumes
+	llCopy := collected.logLevelVolumes
+	countersCopy := collected.counters
+	routeCostsCopy := collected.routeCosts
+	if dropped := atomic.SwapInt64(&droppedMetrics, 0); dropped > 0 {
+		countersCopy[newCounter("metrics_dropped")] += int(dropped)
+	}
+
+	talkers := flushTalkers()
 
-	lrCopy := logRouteVolumes
-	logRouteVolumes = map[logRoute]int{}
+	appLines := map[envApp]int{}
+	for eat, vol := range eatCopy {
+		appLines[envApp{eat.env, eat.app}] += vol.count
+	}
+	volumeSpikes := spikes.observe(appLines)
 
 	// do work that involves network calls async
 	go func() {
@@ -141,9 +470,14 @@ func shipMetrics(dd DDMetricsAPI) {
 				"application:" + lr.app,
 				"route:" + lr.ruleName,
 			}
+			metric := "kinesis_alerts_consumer.log_route_count"
+			if lr.suppressed != "" {
+				metric = "kinesis_alerts_consumer.log_route_suppressed"
+				tags = append(tags, "reason:"+lr.suppressed)
+			}
 			metrics = append(metrics,
 				datadog.MetricSeries{
-					Metric: "kinesis_alerts_consumer.log_route_count",
+					Metric: metric,
 					Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
 					Tags:   tags,
 					Points: []datadog.MetricPoint{
@@ -156,17 +490,169 @@ func shipMetrics(dd DDMetricsAPI) {
 			)
 		}
 
-		err := retry.Run(func() error {
-			acc, res, err := dd.SubmitMetrics(datadog.NewDefaultContext(context.Background()), *datadog.NewMetricPayload(metrics))
-			lg.TraceD("send-log-volumes", logger.M{"total-logs": totalCount, "total-size": totalSize, "point-count": len(metrics), "dd-response": acc.Status})
-			if res.StatusCode != 202 || err != nil {
-				// Make a best attempt at reading the body, if we error here then ¯\_(ツ)_/¯
-				b, _ := ioutil.ReadAll(res.Body)
-				return fmt.Errorf("status code %d received from DD api Err = %v RawBody = %s", res.StatusCode, err, b)
+		for ll, n := range llCopy {
+			tags := []string{
+				"env:" + ll.env,
+				"application:" + ll.app,
+				"level:" + ll.level,
 			}
-			return nil
-		})
-		if err != nil {
+			metrics = append(metrics,
+				datadog.MetricSeries{
+					Metric: "kinesis_alerts_consumer.log_level_count",
+					Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
+					Tags:   tags,
+					Points: []datadog.MetricPoint{
+						{
+							Timestamp: datadog.PtrInt64(time.Now().Unix()),
+							Value:     aws.Float64(float64(n)),
+						},
+					},
+				},
+			)
+		}
+
+		for key, cost := range routeCostsCopy {
+			tags := []string{
+				"env:" + key.env,
+				"application:" + key.app,
+				"team:" + key.team,
+				"route:" + key.rule,
+				"outcome:" + key.outcome,
+			}
+			for _, m := range []struct {
+				name       string
+				metricType datadog.MetricIntakeType
+				value      int
+				tags       []string
+			}{
+				{"route_messages", datadog.METRICINTAKETYPE_COUNT, cost.messages, tags},
+				{"route_bytes", datadog.METRICINTAKETYPE_COUNT, cost.bytes, tags},
+				{"route_points", datadog.METRICINTAKETYPE_COUNT, cost.points, tags},
+				// Distinct series can't be summed across intervals, or across processes that see
+				// the same series, so every process ships its own count
+				{"route_series", datadog.METRICINTAKETYPE_GAUGE, len(cost.series), append(tags[:len(tags):len(tags)], "consumer:"+consumerID)},
+			} {
+				metrics = append(metrics,
+					datadog.MetricSeries{
+						Metric: "kinesis_alerts_consumer." + m.name,
+						Type:   m.metricType.Ptr(),
+						Tags:   m.tags,
+						Points: []datadog.MetricPoint{
+							{
+								Timestamp: datadog.PtrInt64(time.Now().Unix()),
+								Value:     aws.Float64(float64(m.value)),
+							},
+						},
+					},
+				)
+			}
+		}
+
+		for c, n := range countersCopy {
+			metrics = append(metrics,
+				datadog.MetricSeries{
+					Metric: "kinesis_alerts_consumer." + c.name,
+					Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
+					Tags:   c.tagList(),
+					Points: []datadog.MetricPoint{
+						{
+							Timestamp: datadog.PtrInt64(time.Now().Unix()),
+							Value:     aws.Float64(float64(n)),
+						},
+					},
+				},
+			)
+		}
+
+		for sink, state := range breakerStates() {
+			metrics = append(metrics,
+				datadog.MetricSeries{
+					Metric: "kinesis_alerts_consumer.circuit_breaker_state",
+					Type:   datadog.METRICINTAKETYPE_GAUGE.Ptr(),
+					Tags:   []string{"sink:" + sink, "consumer:" + consumerID},
+					Points: []datadog.MetricPoint{
+						{
+							Timestamp: datadog.PtrInt64(time.Now().Unix()),
+							Value:     aws.Float64(breakerStateValues[state]),
+						},
+					},
+				},
+			)
+		}
+
+		for quota, usage := range quotaUsages(time.Now()) {
+			metrics = append(metrics,
+				datadog.MetricSeries{
+					Metric: "kinesis_alerts_consumer.log_quota_usage",
+					Type:   datadog.METRICINTAKETYPE_GAUGE.Ptr(),
+					Tags:   []string{"quota:" + quota.name, "period:" + quota.period, "consumer:" + consumerID},
+					Points: []datadog.MetricPoint{
+						{
+							Timestamp: datadog.PtrInt64(time.Now().Unix()),
+							Value:     aws.Float64(usage * 100),
+						},
+					},
+				},
+			)
+		}
+
+		for _, spike := range volumeSpikes {
+			value := 0.0
+			if spike.spiking {
+				value = 1
+			}
+			metrics = append(metrics,
+				datadog.MetricSeries{
+					Metric: "kinesis_alerts_consumer.volume_spike",
+					Type:   datadog.METRICINTAKETYPE_GAUGE.Ptr(),
+					Tags:   []string{"env:" + spike.env, "application:" + spike.app, "consumer:" + consumerID},
+					Points: []datadog.MetricPoint{
+						{
+							Timestamp: datadog.PtrInt64(time.Now().Unix()),
+							Value:     aws.Float64(value),
+						},
+					},
+				},
+			)
+		}
+
+		for by, top := range talkers {
+			for rank, t := range top {
+				tags := []string{
+					"by:" + by,
+					"talker:" + t.Key,
+					"rank:" + strconv.Itoa(rank+1),
+					"consumer:" + consumerID,
+				}
+				metrics = append(metrics,
+					datadog.MetricSeries{
+						Metric: "kinesis_alerts_consumer.top_talker_share",
+						Type:   datadog.METRICINTAKETYPE_GAUGE.Ptr(),
+						Tags:   tags,
+						Points: []datadog.MetricPoint{
+							{
+								Timestamp: datadog.PtrInt64(time.Now().Unix()),
+								Value:     aws.Float64(t.Share * 100),
+							},
+						},
+					},
+					datadog.MetricSeries{
+						Metric: "kinesis_alerts_consumer.top_talker_size",
+						Type:   datadog.METRICINTAKETYPE_COUNT.Ptr(),
+						Tags:   tags,
+						Points: []datadog.MetricPoint{
+							{
+								Timestamp: datadog.PtrInt64(time.Now().Unix()),
+								Value:     aws.Float64(float64(t.Bytes)),
+							},
+						},
+					},
+				)
+			}
+		}
+
+		lg.TraceD("send-log-volumes", logger.M{"total-logs": totalCount, "total-size": totalSize, "point-count": len(metrics)})
+		if err := dd.submit(metrics); err != nil {
 			lg.ErrorD("failed-sending-volumes", logger.M{"total-logs": totalCount, "total-size": totalSize, "error": err.Error()})
 		}
 	}()
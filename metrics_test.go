@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Clever/kinesis-alerts-consumer/testharness"
+)
+
+func TestRecordMetricsMergesShards(t *testing.T) {
+	collectMetrics()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				recordMetrics("production", "my-app", "eng-team", "my-app/-", 10, []string{"rule-a", "rule-b"})
+				recordCounter("test_counter", 2, "tag:a")
+			}
+		}()
+	}
+	wg.Wait()
+
+	collected := collectMetrics()
+	assert.Equal(t, map[envAppTeam]volume{{"production", "my-app", "eng-team"}: {count: 10000, size: 100000}},
+		collected.envAppTeamVolumes)
+	assert.Equal(t, map[logRoute]int{
+		{"my-app", "production", "rule-a", ""}: 10000,
+		{"my-app", "production", "rule-b", ""}: 10000,
+	}, collected.logRouteVolumes)
+	assert.Equal(t, 20000, collected.counters[newCounter("test_counter", "tag:a")])
+
+	assert.Empty(t, collectMetrics().envAppTeamVolumes)
+}
+
+func TestCounterTagsKeepCommas(t *testing.T) {
+	c := newCounter("route_errors", "route:a,b", "reason:value_type")
+	assert.Equal(t, []string{"route:a,b", "reason:value_type"}, c.tagList())
+	assert.NotEqual(t, newCounter("route_errors", "route:a", "b", "reason:value_type"), c)
+	assert.Equal(t, []string{}, newCounter("metrics_dropped").tagList())
+}
+
+func TestRecordMetricsDropsNewSeriesWhenShardsAreFull(t *testing.T) {
+	collectMetrics()
+	atomic.StoreInt64(&droppedMetrics, 0)
+
+	for i := 0; i < metricsShards*maxShardKeys+5; i++ {
+		recordCounter("test_counter", 1, fmt.Sprintf("n:%d", i))
+	}
+	// Metrics recorded in the background by other tests can be dropped too
+	assert.True(t, atomic.LoadInt64(&droppedMetrics) >= 5)
+	collected := collectMetrics()
+	assert.Len(t, collected.counters, metricsShards*maxShardKeys)
+	atomic.StoreInt64(&droppedMetrics, 0)
+}
+
+func TestShipMetricsReportsDroppedMetrics(t *testing.T) {
+	intake := testharness.NewDatadogIntake()
+	defer intake.Close()
+	dd, err := newDDClient(defaultDDDestination, "test-key", ddSettings{ServerURL: intake.URL})
+	require.NoError(t, err)
+
+	collectMetrics()
+	atomic.StoreInt64(&droppedMetrics, 7)
+	shipMetrics(dd)
+
+	require.True(t, intake.WaitForRequests(1, 5*time.Second))
+	dropped := 0.0
+	for _, s := range intake.Series() {
+		if s.Metric == "kinesis_alerts_consumer.metrics_dropped" {
+			dropped += *s.Points[0].Value
+		}
+	}
+	assert.Equal(t, 7.0, dropped)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&droppedMetrics))
+}
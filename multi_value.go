@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+)
+
+// multiValueConfig emits several values of the logs of an alert rule, or of every rule of a
+// series, e.g. the p50, p99 and count of {"p50": 12, "p99": 80, "count": 3}
+type multiValueConfig struct {
+	// Exactly one of Rule and Series is set. Rule configs take precedence over series ones.
+	Rule   string `yaml:"rule"`
+	Series string `yaml:"series"`
+	// ValueFields are emitted instead of the route's value_field. Each is its own series, the
+	// route's series suffixed with the last segment of the field, e.g. "api.latency.p99" for
+	// "stats.p99".
+	ValueFields []string `yaml:"value_fields"`
+	// TimestampField is the timestamp of each point, instead of the log's, e.g. "batch.*.time"
+	// for the elements of "batch.*.millis". It's an RFC 3339 time or Unix seconds.
+	TimestampField string `yaml:"timestamp_field"`
+}
+
+// name identifies the config in errors, e.g. "rule/api-latency"
+func (c multiValueConfig) name() string {
+	if c.Rule != "" {
+		return "rule/" + c.Rule
+	}
+	return "series/" + c.Series
+}
+
+func (c multiValueConfig) validate() error {
+	if (c.Rule == "") == (c.Series == "") {
+		return fmt.Errorf("multi value route must have exactly one of rule and series")
+	}
+	if len(c.ValueFields) == 0 && c.TimestampField == "" {
+		return fmt.Errorf("multi value route %s must have value_fields or a timestamp_field", c.name())
+	}
+	suffixes := map[string]string{}
+	for _, field := range c.ValueFields {
+		suffix := valueFieldSuffix(field)
+		if suffix == "" {
+			return fmt.Errorf("multi value route %s has invalid value field %s", c.name(), field)
+		}
+		if other, ok := suffixes[suffix]; ok {
+			return fmt.Errorf("multi value route %s has value fields %s and %s with the same suffix %s", c.name(), other, field, suffix)
+		}
+		suffixes[suffix] = field
+	}
+	return nil
+}
+
+// valueFieldSuffix is the suffix of the series of a value field: the last segment of its name
+func valueFieldSuffix(field string) string {
+	name := fieldName(field)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// routeValue is a value field of a route, and the suffix of its series
+type routeValue struct {
+	field  string
+	suffix string
+}
+
+// multiValueRoutes find the values and timestamps of routes with several points.
+//
+// A nil *multiValueRoutes emits the value_field of every route, at the log's timestamp.
+type multiValueRoutes struct {
+	byRule   map[string]multiValueConfig
+	bySeries map[string]multiValueConfig
+}
+
+func newMultiValueRoutes(configs []multiValueConfig) *multiValueRoutes {
+	m := &multiValueRoutes{
+		byRule:   map[string]multiValueConfig{},
+		bySeries: map[string]multiValueConfig{},
+	}
+	for _, config := range configs {
+		if config.Rule != "" {
+			m.byRule[config.Rule] = config
+		} else {
+			m.bySeries[config.Series] = config
+		}
+	}
+	return m
+}
+
+func (m *multiValueRoutes) config(route decode.AlertRoute) (multiValueConfig, bool) {
+	if m == nil {
+		return multiValueConfig{}, false
+	}
+	config, ok := m.byRule[route.RuleName]
+	if !ok {
+		config, ok = m.bySeries[route.Series]
+	}
+	return config, ok
+}
+
+// values returns the value fields of a route
+func (m *multiValueRoutes) values(route decode.AlertRoute) []routeValue {
+	config, ok := m.config(route)
+	if !ok || len(config.ValueFields) == 0 {
+		return []routeValue{{field: route.ValueField}}
+	}
+	values := make([]routeValue, len(config.ValueFields))
+	for i, field := range config.ValueFields {
+		values[i] = routeValue{field: field, suffix: "." + valueFieldSuffix(field)}
+	}
+	return values
+}
+
+// timestamp returns the time of a route's point at index, falling back to the log's timestamp
+func (m *multiValueRoutes) timestamp(route decode.AlertRoute, fields map[string]interface{}, index string, logTimestamp time.Time) (time.Time, error) {
+	config, ok := m.config(route)
+	if !ok || config.TimestampField == "" {
+		return logTimestamp, nil
+	}
+	val, ok := lookupField(fields, fieldAtIndex(config.TimestampField, index))
+	if !ok {
+		return logTimestamp, nil
+	}
+	switch t := val.(type) {
+	case time.Time:
+		return t, nil
+	case float64:
+		sec := int64(t)
+		return time.Unix(sec, int64((t-float64(sec))*1e9)).UTC(), nil
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf(
+		"timestamp exists but is wrong type. rule=%s timestamp_field=%s timestamp=%v",
+		route.RuleName, config.TimestampField, val,
+	)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiValueRoutes(t *testing.T) {
+	m := newMultiValueRoutes([]multiValueConfig{
+		{Rule: "latency-rule", ValueFields: []string{"stats.p50", "/stats/p99", "count"}},
+		{Series: "batch", TimestampField: "batch.*.time"},
+	})
+	latency := decode.AlertRoute{RuleName: "latency-rule", Series: "latency", ValueField: "millis"}
+	batch := decode.AlertRoute{RuleName: "batch-rule", Series: "batch", ValueField: "batch.*.millis"}
+	other := decode.AlertRoute{RuleName: "other-rule", Series: "other", ValueField: "millis"}
+
+	assert.Equal(t, []routeValue{
+		{field: "stats.p50", suffix: ".p50"},
+		{field: "/stats/p99", suffix: ".p99"},
+		{field: "count", suffix: ".count"},
+	}, m.values(latency))
+	assert.Equal(t, []routeValue{{field: "batch.*.millis"}}, m.values(batch))
+	assert.Equal(t, []routeValue{{field: "millis"}}, m.values(other))
+
+	logTimestamp := time.Unix(100, 0)
+	fields := map[string]interface{}{
+		"batch": []interface{}{
+			map[string]interface{}{"time": "2021-06-01T10:30:00.5Z"},
+			map[string]interface{}{"time": float64(1622543400.25)},
+			map[string]interface{}{},
+			map[string]interface{}{"time": "yesterday"},
+		},
+	}
+	ts, err := m.timestamp(batch, fields, "0", logTimestamp)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 6, 1, 10, 30, 0, 5e8, time.UTC), ts)
+	ts, err = m.timestamp(batch, fields, "1", logTimestamp)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 6, 1, 10, 30, 0, 25e7, time.UTC), ts)
+	ts, err = m.timestamp(batch, fields, "2", logTimestamp)
+	require.NoError(t, err)
+	assert.Equal(t, logTimestamp, ts)
+	_, err = m.timestamp(batch, fields, "3", logTimestamp)
+	assert.EqualError(t, err, "timestamp exists but is wrong type. rule=batch-rule timestamp_field=batch.*.time timestamp=yesterday")
+	ts, err = m.timestamp(other, fields, "0", logTimestamp)
+	require.NoError(t, err)
+	assert.Equal(t, logTimestamp, ts)
+
+	var none *multiValueRoutes
+	assert.Equal(t, []routeValue{{field: "millis"}}, none.values(latency))
+}
+
+func TestMultiValueConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "value fields",
+			config: multiValueConfig{Rule: "latency-rule", ValueFields: []string{"p50", "p99", "count"}},
+		},
+		{
+			name:   "timestamp field",
+			config: multiValueConfig{Series: "batch", TimestampField: "batch.*.time"},
+		},
+		{
+			name:    "rule and series",
+			config:  multiValueConfig{Rule: "latency-rule", Series: "latency", ValueFields: []string{"p50"}},
+			wantErr: "exactly one of rule and series",
+		},
+		{
+			name:    "nothing",
+			config:  multiValueConfig{Rule: "latency-rule"},
+			wantErr: "must have value_fields or a timestamp_field",
+		},
+		{
+			name:    "same suffix",
+			config:  multiValueConfig{Rule: "latency-rule", ValueFields: []string{"read.p50", "write.p50"}},
+			wantErr: "value fields read.p50 and write.p50 with the same suffix p50",
+		},
+		{
+			name:    "empty field",
+			config:  multiValueConfig{Rule: "latency-rule", ValueFields: []string{""}},
+			wantErr: "invalid value field",
+		},
+	})
+}
+
+func TestEncodeMessageMultiValueRoutes(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableMultiValueRoutes([]multiValueConfig{
+		{Rule: "latency-rule", ValueFields: []string{"p50", "p99", "count"}},
+		{Rule: "batch-rule", TimestampField: "batch.*.time"},
+	})
+
+	input := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"p50": 12,
+		"p99": 80,
+		"count": 3,
+		"samples": [5, 7],
+		"batch": [{"name": "a", "millis": 10, "time": 1622543400}, {"name": "b", "millis": 20}],
+		"Hostname": "my-hostname",
+		"_kvmeta": {
+			"team": "eng-team",
+			"routes": [
+				{"type": "alerts", "series": "latency", "dimensions": [], "stat_type": "gauge", "rule": "latency-rule"},
+				{"type": "alerts", "series": "samples", "dimensions": [], "stat_type": "gauge", "value_field": "samples", "rule": "samples-rule"},
+				{"type": "alerts", "series": "batch", "dimensions": ["batch.*.name"], "stat_type": "gauge", "value_field": "batch.*.millis", "rule": "batch-rule"}
+			]
+		}
+	}`), &input))
+	input["timestamp"] = time.Unix(0, 0)
+
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+
+	type point struct {
+		metric    string
+		tags      []string
+		timestamp int64
+		value     float64
+	}
+	points := []point{}
+	for _, m := range eo.DDMetrics {
+		points = append(points, point{m.Metric, m.Tags, *m.Points[0].Timestamp, *m.Points[0].Value})
+	}
+	assert.Equal(t, []point{
+		{"kv.latency.p50", []string{"hostname:my-hostname"}, 0, 12},
+		{"kv.latency.p99", []string{"hostname:my-hostname"}, 0, 80},
+		{"kv.latency.count", []string{"hostname:my-hostname"}, 0, 3},
+		{"kv.samples", []string{"hostname:my-hostname"}, 0, 5},
+		{"kv.samples", []string{"hostname:my-hostname"}, 0, 7},
+		{"kv.batch", []string{"batch.name:a", "hostname:my-hostname"}, 1622543400, 10},
+		{"kv.batch", []string{"batch.name:b", "hostname:my-hostname"}, 0, 20},
+	}, points)
+}
+
+func TestEncodeMessageLimitsMultiValuePoints(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.limitRoutePoints(routePointsConfig{Max: 3})
+	// Each value field expands to 2 points, within the max, but the route totals 4
+	consumer.enableMultiValueRoutes([]multiValueConfig{
+		{Rule: "batch-rule", ValueFields: []string{"batch.*.read", "batch.*.write"}},
+	})
+
+	input := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"batch": [{"read": 1, "write": 2}, {"read": 3, "write": 4}],
+		"Hostname": "my-hostname",
+		"_kvmeta": {
+			"team": "eng-team",
+			"routes": [
+				{"type": "alerts", "series": "batch", "dimensions": [], "stat_type": "gauge", "rule": "batch-rule"}
+			]
+		}
+	}`), &input))
+	input["timestamp"] = time.Unix(0, 0)
+
+	collectMetrics()
+	_, _, err := consumer.encodeMessage(input, 0)
+	assert.EqualError(t, err, "route expands to too many points. rule=batch-rule points=4 max=3")
+
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("route_errors", "route:batch-rule", "reason:too_many_points", "team:eng-team")])
+}
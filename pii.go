@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// Actions for dimension values that match a PII rule
+	piiReject = "reject"
+	piiRedact = "redact"
+	piiHash   = "hash"
+
+	piiRedacted = "redacted"
+	// piiHashPrefix marks hashed values, which are the first 16 hex characters of an HMAC-SHA256
+	piiHashPrefix = "pii_"
+)
+
+// piiPatterns are the built in PII rules, by name
+var piiPatterns = map[string]string{
+	"email":      `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"phone":      `(?:^|[^\d])(?:\+?1[-. ]?)?\(?\d{3}\)?[-. ]?\d{3}[-. ]\d{4}(?:$|[^\d])`,
+	"numeric_id": `(?:^|[^\d])\d{9,}(?:$|[^\d])`,
+}
+
+// piiConfig configures the scrubbing of PII from dimension values
+type piiConfig struct {
+	// HashKeyEnv is the name of the environment variable holding the key of hashed values. It's
+	// required if any rule hashes.
+	HashKeyEnv string          `yaml:"hash_key_env"`
+	Rules      []piiRuleConfig `yaml:"rules"`
+}
+
+type piiRuleConfig struct {
+	// Name is one of the built in rules (email, phone, numeric_id), or the name of a custom rule
+	Name string `yaml:"name"`
+	// Pattern is the regular expression of a custom rule. It overrides the built in pattern.
+	Pattern string `yaml:"pattern"`
+	// Action is reject (drop the dimension), redact or hash
+	Action string `yaml:"action"`
+}
+
+func (c piiConfig) validate() error {
+	hashes := false
+	for _, rule := range c.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("pii rule is missing a name")
+		}
+		if _, ok := piiPatterns[rule.Name]; !ok && rule.Pattern == "" {
+			return fmt.Errorf("pii rule %s needs a pattern", rule.Name)
+		}
+		if rule.Pattern != "" {
+			if _, err := regexp.Compile(rule.Pattern); err != nil {
+				return fmt.Errorf("pii rule %s has an invalid pattern: %s", rule.Name, err)
+			}
+		}
+		switch rule.Action {
+		case piiReject, piiRedact:
+		case piiHash:
+			hashes = true
+		default:
+			return fmt.Errorf("pii rule %s has invalid action %s, must be reject, redact or hash", rule.Name, rule.Action)
+		}
+	}
+	if hashes && c.HashKeyEnv == "" {
+		return fmt.Errorf("pii hash_key_env is required to hash values")
+	}
+	return nil
+}
+
+type piiRule struct {
+	name   string
+	re     *regexp.Regexp
+	action string
+}
+
+// piiScrubber applies PII rules to dimension values. Rules are checked in order, and the first
+// that matches anywhere in a value applies to the whole value.
+//
+// A nil *piiScrubber has no rules.
+type piiScrubber struct {
+	rules   []piiRule
+	hashKey []byte
+}
+
+// newPIIScrubber creates a scrubber from a validated config
+func newPIIScrubber(config piiConfig, hashKey string) *piiScrubber {
+	s := &piiScrubber{hashKey: []byte(hashKey)}
+	for _, rule := range config.Rules {
+		pattern := rule.Pattern
+		if pattern == "" {
+			pattern = piiPatterns[rule.Name]
+		}
+		s.rules = append(s.rules, piiRule{
+			name:   rule.Name,
+			re:     regexp.MustCompile(pattern),
+			action: rule.Action,
+		})
+	}
+	return s
+}
+
+// match returns the first rule that matches val, or nil
+func (s *piiScrubber) match(val string) *piiRule {
+	if s == nil {
+		return nil
+	}
+	for i := range s.rules {
+		if s.rules[i].re.MatchString(val) {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+// apply returns the value to use instead of val for a redact or hash rule
+func (s *piiScrubber) apply(rule *piiRule, val string) string {
+	if rule.action == piiHash {
+		mac := hmac.New(sha256.New, s.hashKey)
+		mac.Write([]byte(val))
+		return piiHashPrefix + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return piiRedacted
+}
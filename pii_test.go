@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPIIScrubber(t *testing.T) {
+	s := newPIIScrubber(piiConfig{Rules: []piiRuleConfig{
+		{Name: "email", Action: piiHash},
+		{Name: "phone", Action: piiRedact},
+		{Name: "numeric_id", Action: piiReject},
+		{Name: "ssn", Pattern: `\b\d{3}-\d{2}-\d{4}\b`, Action: piiRedact},
+	}}, "secret")
+
+	tests := []struct {
+		val      string
+		wantRule string
+		want     string
+	}{
+		{val: "jane.doe+test@example.com", wantRule: "email", want: "pii_bdae94f2e6c3c978"},
+		{val: "user JANE@EXAMPLE.ORG failed", wantRule: "email", want: "pii_19b3d471bc0b8479"},
+		{val: "(415) 555-0100", wantRule: "phone", want: piiRedacted},
+		{val: "+1 415.555.0100", wantRule: "phone", want: piiRedacted},
+		{val: "123456789", wantRule: "numeric_id"},
+		{val: "student-5551234567890", wantRule: "numeric_id"},
+		{val: "123-45-6789", wantRule: "ssn", want: piiRedacted},
+		{val: "12345678"},
+		{val: "my-app"},
+		{val: "ip-10-0-1-123"},
+		{val: "5a15d5f70c3828572b00001d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			rule := s.match(tt.val)
+			if tt.wantRule == "" {
+				assert.Nil(t, rule)
+				return
+			}
+			require.NotNil(t, rule)
+			assert.Equal(t, tt.wantRule, rule.name)
+			if rule.action != piiReject {
+				assert.Equal(t, tt.want, s.apply(rule, tt.val))
+			}
+		})
+	}
+}
+
+func TestPIIScrubberHashesWithKey(t *testing.T) {
+	rules := piiConfig{Rules: []piiRuleConfig{{Name: "email", Action: piiHash}}}
+	a := newPIIScrubber(rules, "key-a")
+	b := newPIIScrubber(rules, "key-b")
+
+	email := "jane@example.com"
+	hashA := a.apply(a.match(email), email)
+	assert.Equal(t, hashA, a.apply(a.match(email), email))
+	assert.NotEqual(t, hashA, b.apply(b.match(email), email))
+	assert.Len(t, hashA, len(piiHashPrefix)+16)
+}
+
+func TestPIIConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "built in rules",
+			config: piiConfig{Rules: []piiRuleConfig{{Name: "email", Action: piiRedact}, {Name: "phone", Action: piiReject}}},
+		},
+		{
+			name:    "custom rule without a pattern",
+			config:  piiConfig{Rules: []piiRuleConfig{{Name: "ssn", Action: piiRedact}}},
+			wantErr: "pii rule ssn needs a pattern",
+		},
+		{
+			name:    "invalid pattern",
+			config:  piiConfig{Rules: []piiRuleConfig{{Name: "ssn", Pattern: `(\d{3}`, Action: piiRedact}}},
+			wantErr: "pii rule ssn has an invalid pattern",
+		},
+		{
+			name:    "invalid action",
+			config:  piiConfig{Rules: []piiRuleConfig{{Name: "email", Action: "mask"}}},
+			wantErr: "invalid action mask",
+		},
+		{
+			name:    "hash without a key",
+			config:  piiConfig{Rules: []piiRuleConfig{{Name: "email", Action: piiHash}}},
+			wantErr: "hash_key_env is required",
+		},
+	})
+}
+
+func TestEncodeMessageScrubsPII(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enablePIIScrubbing(piiConfig{Rules: []piiRuleConfig{
+		{Name: "email", Action: piiRedact},
+		{Name: "numeric_id", Action: piiReject},
+	}}, "")
+
+	input := map[string]interface{}{
+		"user":       "jane@example.com",
+		"student_id": float64(1234567890),
+		"district":   "ddd",
+		"Hostname":   "my-hostname",
+		"timestamp":  time.Unix(0, 0),
+		"_kvmeta": map[string]interface{}{
+			"team": "eng-team",
+			"routes": []interface{}{
+				map[string]interface{}{
+					"type":       "alerts",
+					"series":     "login",
+					"dimensions": []interface{}{"user", "student_id", "district"},
+					"stat_type":  "counter",
+					"rule":       "login-count",
+				},
+			},
+		},
+	}
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 1)
+	assert.Equal(t, []string{"user:redacted", "district:ddd", "hostname:my-hostname"}, eo.DDMetrics[0].Tags)
+
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("pii_scrubbed", "route:login-count", "dimension:user", "pii:email", "action:redact", "team:eng-team")])
+	assert.Equal(t, 1, counters[newCounter("pii_scrubbed", "route:login-count", "dimension:student_id", "pii:numeric_id", "action:reject", "team:eng-team")])
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+const (
+	quotaHourly = "hourly"
+	quotaDaily  = "daily"
+
+	// What happens to the alert routes of logs from an app that is over its quota
+	overQuotaNone   = "none"
+	overQuotaSample = "sample"
+	overQuotaDrop   = "drop"
+)
+
+// quotaThresholds are the shares of a quota whose crossing is reported
+var quotaThresholds = []float64{0.5, 0.9, 1}
+
+var (
+	// logQuotas are all the quotas tracked, so their usage can be shipped with the volume metrics
+	logQuotas   = []*logQuota{}
+	logQuotasMu sync.Mutex
+)
+
+// quotaConfig is a log volume budget for a team or an app. Budgets apply to each consumer
+// process, which sees only the logs of the shards it consumes, so with N processes a team or app
+// may log up to N times its budget before all of them enforce it.
+type quotaConfig struct {
+	// Exactly one of Team and App is set
+	Team string `yaml:"team"`
+	App  string `yaml:"app"`
+	// Period is hourly or daily (UTC). Defaults to daily.
+	Period string `yaml:"period"`
+	// MaxBytes and MaxLines are the budgets for the period. Zero means no budget.
+	MaxBytes int64 `yaml:"max_bytes"`
+	MaxLines int64 `yaml:"max_lines"`
+	// OverQuota is what happens to the alert routes of logs once the quota is used up: none (the
+	// default), sample or drop. The logs are still counted in the volume metrics.
+	OverQuota string `yaml:"over_quota"`
+	// SampleRate is the share of logs whose routes are processed when OverQuota is sample
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+func (c quotaConfig) withDefaults() quotaConfig {
+	if c.Period == "" {
+		c.Period = quotaDaily
+	}
+	if c.OverQuota == "" {
+		c.OverQuota = overQuotaNone
+	}
+	return c
+}
+
+// name identifies the quota in logs and metrics, e.g. "team/eng-infra"
+func (c quotaConfig) name() string {
+	if c.Team != "" {
+		return "team/" + c.Team
+	}
+	return "app/" + c.App
+}
+
+func (c quotaConfig) validate() error {
+	if (c.Team == "") == (c.App == "") {
+		return fmt.Errorf("log quota must have exactly one of team and app")
+	}
+	c = c.withDefaults()
+	if c.Period != quotaHourly && c.Period != quotaDaily {
+		return fmt.Errorf("log quota %s has invalid period %s, must be hourly or daily", c.name(), c.Period)
+	}
+	if c.MaxBytes < 0 || c.MaxLines < 0 || (c.MaxBytes == 0 && c.MaxLines == 0) {
+		return fmt.Errorf("log quota %s must have a positive max_bytes or max_lines", c.name())
+	}
+	switch c.OverQuota {
+	case overQuotaNone, overQuotaDrop:
+	case overQuotaSample:
+		if c.SampleRate <= 0 || c.SampleRate > 1 {
+			return fmt.Errorf("log quota %s has invalid sample_rate %v, must be in (0, 1]", c.name(), c.SampleRate)
+		}
+	default:
+		return fmt.Errorf("log quota %s has invalid over_quota %s, must be none, sample or drop", c.name(), c.OverQuota)
+	}
+	return nil
+}
+
+// logQuota tracks the volume logged against a quota in its current period
+type logQuota struct {
+	config quotaConfig
+
+	mu          sync.Mutex
+	periodStart time.Time
+	bytes       int64
+	lines       int64
+	// crossed is how many of quotaThresholds have been crossed this period
+	crossed int
+}
+
+// add counts a log against the quota, and returns the share of the quota used
+func (q *logQuota) add(now time.Time, numBytes int) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if start := q.startOfPeriod(now); start.After(q.periodStart) {
+		q.periodStart = start
+		q.bytes = 0
+		q.lines = 0
+		q.crossed = 0
+	}
+	q.bytes += int64(numBytes)
+	q.lines++
+
+	usage := q.usageLocked()
+	for q.crossed < len(quotaThresholds) && usage >= quotaThresholds[q.crossed] {
+		threshold := fmt.Sprintf("%.0f", quotaThresholds[q.crossed]*100)
+		lg.WarnD("log-quota-threshold", logger.M{
+			"quota": q.config.name(), "period": q.config.Period, "threshold": threshold,
+			"bytes": q.bytes, "lines": q.lines, "max-bytes": q.config.MaxBytes, "max-lines": q.config.MaxLines,
+		})
+		recordCounter("log_quota_threshold", 1, "quota:"+q.config.name(), "period:"+q.config.Period, "threshold:"+threshold)
+		q.crossed++
+	}
+	return usage
+}
+
+func (q *logQuota) startOfPeriod(now time.Time) time.Time {
+	now = now.UTC()
+	if q.config.Period == quotaHourly {
+		return now.Truncate(time.Hour)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// usageLocked is the largest share used of the quota's budgets
+func (q *logQuota) usageLocked() float64 {
+	usage := 0.0
+	if q.config.MaxBytes > 0 {
+		usage = float64(q.bytes) / float64(q.config.MaxBytes)
+	}
+	if q.config.MaxLines > 0 {
+		if lines := float64(q.lines) / float64(q.config.MaxLines); lines > usage {
+			usage = lines
+		}
+	}
+	return usage
+}
+
+// usage returns the share of the quota used in its current period
+func (q *logQuota) usage(now time.Time) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.startOfPeriod(now).After(q.periodStart) {
+		return 0
+	}
+	return q.usageLocked()
+}
+
+type quotaKey struct {
+	name   string
+	period string
+}
+
+// quotaUsages returns the share used of every quota
+func quotaUsages(now time.Time) map[quotaKey]float64 {
+	logQuotasMu.Lock()
+	defer logQuotasMu.Unlock()
+	usages := map[quotaKey]float64{}
+	for _, q := range logQuotas {
+		usages[quotaKey{q.config.name(), q.config.Period}] = q.usage(now)
+	}
+	return usages
+}
+
+// quotaTracker counts every log against the quotas of its team and app.
+//
+// A nil *quotaTracker has no quotas.
+type quotaTracker struct {
+	byTeam map[string][]*logQuota
+	byApp  map[string][]*logQuota
+
+	now    func() time.Time
+	sample func() float64
+}
+
+func newQuotaTracker(configs []quotaConfig) *quotaTracker {
+	t := &quotaTracker{
+		byTeam: map[string][]*logQuota{},
+		byApp:  map[string][]*logQuota{},
+		now:    time.Now,
+		sample: rand.Float64,
+	}
+
+	logQuotasMu.Lock()
+	defer logQuotasMu.Unlock()
+	for _, config := range configs {
+		q := &logQuota{config: config.withDefaults()}
+		if config.Team != "" {
+			t.byTeam[config.Team] = append(t.byTeam[config.Team], q)
+		} else {
+			t.byApp[config.App] = append(t.byApp[config.App], q)
+		}
+		logQuotas = append(logQuotas, q)
+	}
+	return t
+}
+
+// add counts a log against the quotas of its app and team. It returns false if the log's alert
+// routes shouldn't be processed because it's over a quota that drops or samples them.
+func (t *quotaTracker) add(app, team string, numBytes int) bool {
+	if t == nil {
+		return true
+	}
+
+	now := t.now()
+	process := true
+	quotas := []*logQuota{}
+	quotas = append(quotas, t.byApp[app]...)
+	quotas = append(quotas, t.byTeam[team]...)
+	for _, q := range quotas {
+		// The quota is used up by the log that reaches it, so only later logs are over it
+		if q.add(now, numBytes) <= 1 {
+			continue
+		}
+		switch q.config.OverQuota {
+		case overQuotaDrop:
+			process = false
+		case overQuotaSample:
+			if t.sample() >= q.config.SampleRate {
+				process = false
+			}
+		}
+	}
+	return process
+}
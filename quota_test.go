@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+)
+
+// quotaThresholdsCrossed returns the thresholds reported in the pipeline metrics
+func quotaThresholdsCrossed() []string {
+	thresholds := []string{}
+	for c := range collectMetrics().counters {
+		if c.name == "log_quota_threshold" {
+			thresholds = append(thresholds, strings.Join(c.tagList(), ","))
+		}
+	}
+	sort.Strings(thresholds)
+	return thresholds
+}
+
+func TestQuotaTrackerThresholds(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	tracker := newQuotaTracker([]quotaConfig{{Team: "eng-team", Period: quotaHourly, MaxBytes: 100, MaxLines: 1000}})
+	tracker.now = func() time.Time { return now }
+	collectMetrics()
+
+	assert.True(t, tracker.add("my-app", "eng-team", 40))
+	assert.Empty(t, quotaThresholdsCrossed())
+
+	// The first log to reach a threshold reports it, and every threshold it skips
+	assert.True(t, tracker.add("my-app", "eng-team", 55))
+	assert.Equal(t, []string{
+		"quota:team/eng-team,period:hourly,threshold:50",
+		"quota:team/eng-team,period:hourly,threshold:90",
+	}, quotaThresholdsCrossed())
+
+	// Without an over_quota action, logs over the quota are still processed
+	assert.True(t, tracker.add("my-app", "eng-team", 5))
+	assert.True(t, tracker.add("my-app", "eng-team", 5))
+	assert.Equal(t, []string{"quota:team/eng-team,period:hourly,threshold:100"}, quotaThresholdsCrossed())
+	assert.InDelta(t, 1.05, quotaUsages(now)[quotaKey{"team/eng-team", quotaHourly}], 0.001)
+
+	// Other teams don't count towards the quota
+	assert.True(t, tracker.add("other-app", "other-team", 500))
+	assert.Empty(t, quotaThresholdsCrossed())
+
+	// The quota resets every period
+	now = now.Add(time.Hour)
+	assert.Equal(t, 0.0, quotaUsages(now)[quotaKey{"team/eng-team", quotaHourly}])
+	assert.True(t, tracker.add("my-app", "eng-team", 60))
+	assert.Equal(t, []string{"quota:team/eng-team,period:hourly,threshold:50"}, quotaThresholdsCrossed())
+}
+
+func TestQuotaTrackerOverQuotaActions(t *testing.T) {
+	tracker := newQuotaTracker([]quotaConfig{
+		{App: "noisy-app", MaxLines: 2, OverQuota: overQuotaDrop},
+		{App: "sampled-app", MaxLines: 2, OverQuota: overQuotaSample, SampleRate: 0.5},
+	})
+	samples := []float64{0.7, 0.2}
+	tracker.sample = func() float64 {
+		s := samples[0]
+		samples = samples[1:]
+		return s
+	}
+
+	assert.True(t, tracker.add("noisy-app", "", 1))
+	assert.True(t, tracker.add("noisy-app", "", 1))
+	assert.False(t, tracker.add("noisy-app", "", 1))
+	assert.False(t, tracker.add("noisy-app", "", 1))
+
+	assert.True(t, tracker.add("sampled-app", "", 1))
+	assert.True(t, tracker.add("sampled-app", "", 1))
+	assert.False(t, tracker.add("sampled-app", "", 1))
+	assert.True(t, tracker.add("sampled-app", "", 1))
+	collectMetrics()
+}
+
+func TestEncodeMessageDropsOverQuotaLogs(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableLogQuotas([]quotaConfig{{App: "my-app", MaxLines: 1, OverQuota: overQuotaDrop}})
+
+	input := func() map[string]interface{} {
+		return map[string]interface{}{
+			"container_app": "my-app",
+			"rawlog":        "panic: runtime error: invalid memory address or nil pointer dereference",
+			"timestamp":     time.Now(),
+		}
+	}
+	_, _, err := consumer.encodeMessage(input(), 10)
+	assert.NoError(t, err)
+	_, _, err = consumer.encodeMessage(input(), 10)
+	assert.Equal(t, kbc.ErrMessageIgnored, err)
+	collectMetrics()
+}
+
+func TestQuotaConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "team quota",
+			config: quotaConfig{Team: "eng-team", MaxBytes: 1000},
+		},
+		{
+			name:   "sampled app quota",
+			config: quotaConfig{App: "my-app", Period: quotaHourly, MaxLines: 1000, OverQuota: overQuotaSample, SampleRate: 0.1},
+		},
+		{
+			name:    "team and app",
+			config:  quotaConfig{Team: "eng-team", App: "my-app", MaxBytes: 1000},
+			wantErr: "exactly one of team and app",
+		},
+		{
+			name:    "no budget",
+			config:  quotaConfig{Team: "eng-team"},
+			wantErr: "must have a positive max_bytes or max_lines",
+		},
+		{
+			name:    "invalid period",
+			config:  quotaConfig{Team: "eng-team", Period: "weekly", MaxBytes: 1000},
+			wantErr: "invalid period weekly",
+		},
+		{
+			name:    "sample without a rate",
+			config:  quotaConfig{App: "my-app", MaxLines: 1000, OverQuota: overQuotaSample},
+			wantErr: "invalid sample_rate",
+		},
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+const (
+	// Why a route failed
+	routeErrorDimensionType = "dimension_type"
+	routeErrorValueType     = "value_type"
+	routeErrorStatType      = "stat_type"
+	routeErrorTimestampType = "timestamp_type"
+	routeErrorTooManyPoints = "too_many_points"
+
+	// routeErrorLogInterval is how often the errors of a rule are logged
+	routeErrorLogInterval = time.Minute
+)
+
+// routeErrorSampler logs the first error of every rule in an interval, so that a rule failing on
+// every log doesn't flood the consumer's logs
+type routeErrorSampler struct {
+	mu sync.Mutex
+	// logged is when each rule's error was last logged, and skipped how many errors weren't since
+	logged  map[string]time.Time
+	skipped map[string]int
+	now     func() time.Time
+}
+
+var routeErrors = &routeErrorSampler{
+	logged:  map[string]time.Time{},
+	skipped: map[string]int{},
+	now:     time.Now,
+}
+
+// sample returns whether an error of rule should be logged, and how many errors of the rule
+// weren't logged before it
+func (s *routeErrorSampler) sample(rule string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if last, ok := s.logged[rule]; ok && now.Sub(last) < routeErrorLogInterval {
+		s.skipped[rule]++
+		return false, 0
+	}
+	skipped := s.skipped[rule]
+	s.logged[rule] = now
+	delete(s.skipped, rule)
+	// Forget rules that haven't failed in a while, so the maps stay small
+	for r, last := range s.logged {
+		if now.Sub(last) >= routeErrorLogInterval && s.skipped[r] == 0 {
+			delete(s.logged, r)
+		}
+	}
+	return true, skipped
+}
+
+// recordRouteError counts a route that failed for reason in kinesis_alerts_consumer.route_errors,
+// and logs it if it's the first error of its rule in a while
+func recordRouteError(route decode.AlertRoute, team, reason string, err error) {
+	recordCounter("route_errors", 1, "route:"+route.RuleName, "reason:"+reason, "team:"+team)
+	if ok, skipped := routeErrors.sample(route.RuleName); ok {
+		lg.ErrorD("route-error", logger.M{
+			"rule": route.RuleName, "series": route.Series, "team": team, "reason": reason,
+			"error": err.Error(), "skipped": skipped,
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteErrorSampler(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)
+	sampler := &routeErrorSampler{
+		logged:  map[string]time.Time{},
+		skipped: map[string]int{},
+		now:     func() time.Time { return now },
+	}
+
+	ok, skipped := sampler.sample("rule-a")
+	assert.True(t, ok)
+	assert.Equal(t, 0, skipped)
+	ok, _ = sampler.sample("rule-a")
+	assert.False(t, ok)
+	ok, _ = sampler.sample("rule-a")
+	assert.False(t, ok)
+	// Rules are sampled separately
+	ok, _ = sampler.sample("rule-b")
+	assert.True(t, ok)
+
+	now = now.Add(routeErrorLogInterval)
+	ok, skipped = sampler.sample("rule-a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, skipped)
+	// rule-b hasn't failed since its error was logged
+	assert.NotContains(t, sampler.logged, "rule-b")
+}
+
+func TestEncodeMessageIsolatesRouteErrors(t *testing.T) {
+	consumer := AlertsConsumer{}
+
+	route := func(rule, statType string, dims ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"type":        "alerts",
+			"series":      rule + "-series",
+			"dimensions":  dims,
+			"stat_type":   statType,
+			"value_field": "value",
+			"rule":        rule,
+		}
+	}
+	input := map[string]interface{}{
+		"container_env": "production",
+		"container_app": "my-app",
+		"value":         float64(3),
+		"dim_ok":        "ok",
+		"dim_error":     []string{"invalid"},
+		"Hostname":      "my-hostname",
+		"timestamp":     time.Unix(0, 0),
+		"_kvmeta": map[string]interface{}{
+			"team": "eng-team",
+			"routes": []interface{}{
+				route("bad-dimension", "counter", "dim_error"),
+				route("bad-stat-type", "histogram"),
+				route("good", "gauge", "dim_ok"),
+			},
+		},
+	}
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(input, 100)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 1)
+	assert.Equal(t, "kv.good-series", eo.DDMetrics[0].Metric)
+	assert.Equal(t, []string{"dim_ok:ok", "hostname:my-hostname"}, eo.DDMetrics[0].Tags)
+
+	collected := collectMetrics()
+	assert.Equal(t, 1, collected.counters[newCounter("route_errors", "route:bad-dimension", "reason:dimension_type", "team:eng-team")])
+	assert.Equal(t, 1, collected.counters[newCounter("route_errors", "route:bad-stat-type", "reason:stat_type", "team:eng-team")])
+	assert.Equal(t, 1, collected.routeCosts[routeCostKey{"production", "my-app", "eng-team", "bad-dimension", routeOutcomeError}].messages)
+	assert.Equal(t, 1, collected.routeCosts[routeCostKey{"production", "my-app", "eng-team", "bad-stat-type", routeOutcomeError}].messages)
+	assert.Equal(t, 1, collected.routeCosts[routeCostKey{"production", "my-app", "eng-team", "good", routeOutcomeEmitted}].points)
+}
+
+func TestEncodeMessageErrorsIfEveryRouteFails(t *testing.T) {
+	consumer := AlertsConsumer{}
+	input := map[string]interface{}{
+		"Hostname":  "my-hostname",
+		"timestamp": time.Unix(0, 0),
+		"_kvmeta": map[string]interface{}{
+			"routes": []interface{}{
+				map[string]interface{}{
+					"type":       "alerts",
+					"series":     "series-name",
+					"dimensions": []interface{}{},
+					"stat_type":  "histogram",
+					"rule":       "rule-1",
+				},
+			},
+		},
+	}
+
+	_, _, err := consumer.encodeMessage(input, 0)
+	assert.EqualError(t, err, "invalid StatType: histogram")
+}
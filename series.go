@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// defaultDDPrefix is prepended to the series of alert routes in Datadog
+const defaultDDPrefix = "kv."
+
+// seriesConfig configures the names of the metrics emitted for alert routes
+type seriesConfig struct {
+	// DatadogPrefix is prepended to series sent to Datadog. Defaults to "kv.".
+	DatadogPrefix *string `yaml:"datadog_prefix"`
+	// CloudWatchPrefix is prepended to series sent to CloudWatch. Defaults to none.
+	CloudWatchPrefix string `yaml:"cloudwatch_prefix"`
+	// Renames emit a route's series under another name
+	Renames []seriesRename `yaml:"renames"`
+	// Deny are patterns (path.Match syntax, e.g. "legacy.*") of series that aren't emitted
+	Deny []string `yaml:"deny"`
+}
+
+type seriesRename struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// DualEmit also emits the series under its old name, while dashboards and monitors migrate
+	DualEmit bool `yaml:"dual_emit"`
+}
+
+func (c seriesConfig) validate() error {
+	renames := map[string]struct{}{}
+	for _, rename := range c.Renames {
+		if rename.From == "" || rename.To == "" {
+			return fmt.Errorf("series rename must have a from and a to")
+		}
+		if rename.From == rename.To {
+			return fmt.Errorf("series rename of %s renames it to itself", rename.From)
+		}
+		if _, ok := renames[rename.From]; ok {
+			return fmt.Errorf("duplicate series rename of %s", rename.From)
+		}
+		renames[rename.From] = struct{}{}
+	}
+	for _, pattern := range c.Deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid series deny pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// seriesMapper maps the series of alert routes to the names of the metrics emitted.
+//
+// A nil *seriesMapper emits every series as is, with the default prefixes.
+type seriesMapper struct {
+	ddPrefix string
+	cwPrefix string
+	renames  map[string]seriesRename
+	deny     []string
+}
+
+// newSeriesMapper creates a mapper from a validated config
+func newSeriesMapper(config seriesConfig) *seriesMapper {
+	m := &seriesMapper{
+		ddPrefix: defaultDDPrefix,
+		cwPrefix: config.CloudWatchPrefix,
+		renames:  map[string]seriesRename{},
+		deny:     config.Deny,
+	}
+	if config.DatadogPrefix != nil {
+		m.ddPrefix = *config.DatadogPrefix
+	}
+	for _, rename := range config.Renames {
+		m.renames[rename.From] = rename
+	}
+	return m
+}
+
+// denied returns the deny pattern that matches a route's series, or "" if it's emitted
+func (m *seriesMapper) denied(series string) string {
+	if m == nil {
+		return ""
+	}
+	for _, pattern := range m.deny {
+		if ok, _ := path.Match(pattern, series); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// names returns the series a route's series is emitted as, without prefixes
+func (m *seriesMapper) names(series string) []string {
+	if m == nil {
+		return []string{series}
+	}
+	rename, ok := m.renames[series]
+	if !ok {
+		return []string{series}
+	}
+	if rename.DualEmit {
+		return []string{rename.To, series}
+	}
+	return []string{rename.To}
+}
+
+// ddMetric returns the Datadog metric name of a series
+func (m *seriesMapper) ddMetric(series string) string {
+	if m == nil {
+		return defaultDDPrefix + series
+	}
+	return m.ddPrefix + series
+}
+
+// cwMetric returns the CloudWatch metric name of a series
+func (m *seriesMapper) cwMetric(series string) string {
+	if m == nil {
+		return series
+	}
+	return m.cwPrefix + series
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	kbc "github.com/Clever/amazon-kinesis-client-go/batchconsumer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesMapper(t *testing.T) {
+	empty := ""
+	mapper := newSeriesMapper(seriesConfig{
+		DatadogPrefix:    &empty,
+		CloudWatchPrefix: "kv/",
+		Renames: []seriesRename{
+			{From: "login", To: "auth.login"},
+			{From: "logout", To: "auth.logout", DualEmit: true},
+		},
+		Deny: []string{"legacy.*", "deprecated"},
+	})
+
+	assert.Equal(t, []string{"auth.login"}, mapper.names("login"))
+	assert.Equal(t, []string{"auth.logout", "logout"}, mapper.names("logout"))
+	assert.Equal(t, []string{"other"}, mapper.names("other"))
+
+	assert.Equal(t, "legacy.*", mapper.denied("legacy.requests"))
+	assert.Equal(t, "deprecated", mapper.denied("deprecated"))
+	assert.Equal(t, "", mapper.denied("deprecated.not"))
+	assert.Equal(t, "", mapper.denied("login"))
+
+	assert.Equal(t, "login", mapper.ddMetric("login"))
+	assert.Equal(t, "kv/login", mapper.cwMetric("login"))
+
+	var defaults *seriesMapper
+	assert.Equal(t, []string{"login"}, defaults.names("login"))
+	assert.Equal(t, "", defaults.denied("login"))
+	assert.Equal(t, "kv.login", defaults.ddMetric("login"))
+	assert.Equal(t, "login", defaults.cwMetric("login"))
+	assert.Equal(t, "kv.login", newSeriesMapper(seriesConfig{}).ddMetric("login"))
+}
+
+func TestSeriesConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "empty",
+			config: seriesConfig{},
+		},
+		{
+			name: "valid",
+			config: seriesConfig{
+				Renames: []seriesRename{{From: "a", To: "b", DualEmit: true}},
+				Deny:    []string{"legacy.*"},
+			},
+		},
+		{
+			name:    "missing to",
+			config:  seriesConfig{Renames: []seriesRename{{From: "a"}}},
+			wantErr: "series rename must have a from and a to",
+		},
+		{
+			name:    "rename to itself",
+			config:  seriesConfig{Renames: []seriesRename{{From: "a", To: "a"}}},
+			wantErr: "series rename of a renames it to itself",
+		},
+		{
+			name:    "duplicate rename",
+			config:  seriesConfig{Renames: []seriesRename{{From: "a", To: "b"}, {From: "a", To: "c"}}},
+			wantErr: "duplicate series rename of a",
+		},
+		{
+			name:    "invalid deny pattern",
+			config:  seriesConfig{Deny: []string{"legacy.["}},
+			wantErr: "invalid series deny pattern legacy.[: syntax error in pattern",
+		},
+	})
+}
+
+func seriesTestInput(series ...string) map[string]interface{} {
+	routes := []interface{}{}
+	for _, s := range series {
+		routes = append(routes, map[string]interface{}{
+			"type":       "alerts",
+			"series":     s,
+			"dimensions": []interface{}{},
+			"stat_type":  "counter",
+			"rule":       s + "-rule",
+		})
+	}
+	return map[string]interface{}{
+		"Hostname":  "my-hostname",
+		"region":    "us-west-1",
+		"timestamp": time.Unix(0, 0),
+		"_kvmeta":   map[string]interface{}{"team": "eng-team", "routes": routes},
+	}
+}
+
+func TestEncodeMessageMapsSeries(t *testing.T) {
+	consumer := AlertsConsumer{}
+	prefix := "clever."
+	consumer.enableSeriesMapping(seriesConfig{
+		DatadogPrefix:    &prefix,
+		CloudWatchPrefix: "kv.",
+		Renames: []seriesRename{
+			{From: "login", To: "auth.login"},
+			{From: "ContainerExitCount", To: "container.exits", DualEmit: true},
+		},
+		Deny: []string{"legacy.*"},
+	})
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(seriesTestInput("login", "ContainerExitCount", "legacy.requests"), 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+
+	metrics := []string{}
+	for _, m := range eo.DDMetrics {
+		metrics = append(metrics, m.Metric)
+	}
+	assert.Equal(t, []string{"clever.auth.login", "clever.container.exits", "clever.ContainerExitCount"}, metrics)
+	// The allowlist is checked before renaming, so CloudWatch gets both names
+	require.Len(t, eo.CWMetrics, 2)
+	assert.Equal(t, "kv.container.exits", *eo.CWMetrics[0].MetricName)
+	assert.Equal(t, "kv.ContainerExitCount", *eo.CWMetrics[1].MetricName)
+
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("series_denied", "route:legacy.requests-rule", "series:legacy.requests")])
+}
+
+func TestEncodeMessageSendsRenamedAllowlistedSeriesToCloudWatch(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableSeriesMapping(seriesConfig{
+		Renames: []seriesRename{{From: "ContainerExitCount", To: "container.exits"}},
+	})
+
+	output, _, err := consumer.encodeMessage(seriesTestInput("ContainerExitCount"), 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.CWMetrics, 1)
+	assert.Equal(t, "container.exits", *eo.CWMetrics[0].MetricName)
+}
+
+func TestEncodeMessageIgnoresDeniedSeries(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableSeriesMapping(seriesConfig{Deny: []string{"legacy.*"}})
+
+	_, _, err := consumer.encodeMessage(seriesTestInput("legacy.requests"), 0)
+	assert.Equal(t, kbc.ErrMessageIgnored, err)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+// spikeConfig configures the detection of apps whose log volume spikes above their baseline
+type spikeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Alpha is the weight of the latest interval in the baseline, an exponentially weighted
+	// moving average of the lines logged per interval
+	Alpha float64 `yaml:"alpha"`
+	// Multiple of the baseline that starts a spike
+	Multiple float64 `yaml:"multiple"`
+	// ClearMultiple of the baseline that a spike has to fall below to end. It's lower than
+	// Multiple, so that a spike doesn't flap around the threshold.
+	ClearMultiple float64 `yaml:"clear_multiple"`
+	// MinLines is the fewest lines in an interval that can be a spike, to ignore quiet apps
+	MinLines int `yaml:"min_lines"`
+	// Warmup is how many intervals an app's baseline is learned before spikes are detected
+	Warmup int `yaml:"warmup"`
+}
+
+func (c spikeConfig) withDefaults() spikeConfig {
+	if c.Alpha <= 0 {
+		c.Alpha = 0.1
+	}
+	if c.Multiple <= 0 {
+		c.Multiple = 5
+	}
+	if c.ClearMultiple <= 0 {
+		c.ClearMultiple = 2
+	}
+	if c.MinLines <= 0 {
+		c.MinLines = 1000
+	}
+	if c.Warmup <= 0 {
+		c.Warmup = 10
+	}
+	return c
+}
+
+func (c spikeConfig) validate() error {
+	c = c.withDefaults()
+	if c.Alpha > 1 {
+		return fmt.Errorf("invalid volume_spikes alpha %v, must be in (0, 1]", c.Alpha)
+	}
+	if c.ClearMultiple > c.Multiple {
+		return fmt.Errorf("volume_spikes clear_multiple %v must not be more than multiple %v", c.ClearMultiple, c.Multiple)
+	}
+	return nil
+}
+
+type envApp struct {
+	env string
+	app string
+}
+
+type spikeBaseline struct {
+	// lines is the moving average of lines per interval
+	lines     float64
+	intervals int
+	spiking   bool
+}
+
+// volumeSpike is the state of an app that is spiking, or stopped spiking, in an interval
+type volumeSpike struct {
+	envApp
+	lines    int
+	baseline float64
+	spiking  bool
+}
+
+// spikeDetector keeps a baseline of the volume of every app, and reports the apps whose volume
+// is above it. It isn't thread safe. Every consumer process has its own, over the volume of only
+// the shards it consumes.
+//
+// A nil *spikeDetector detects no spikes.
+type spikeDetector struct {
+	config    spikeConfig
+	baselines map[envApp]*spikeBaseline
+}
+
+// spikes detects volume spikes in the volume metrics. It's nil unless enabled by configureSpikes.
+var spikes *spikeDetector
+
+// configureSpikes enables volume spike detection. It must be called before processMetrics starts.
+func configureSpikes(config spikeConfig) {
+	if config.Enabled {
+		spikes = newSpikeDetector(config)
+	} else {
+		spikes = nil
+	}
+}
+
+func newSpikeDetector(config spikeConfig) *spikeDetector {
+	return &spikeDetector{
+		config:    config.withDefaults(),
+		baselines: map[envApp]*spikeBaseline{},
+	}
+}
+
+// observe updates the baselines with the lines logged by every app in an interval. It returns
+// the apps that are spiking, and those that stopped spiking in this interval.
+func (d *spikeDetector) observe(lines map[envApp]int) []volumeSpike {
+	if d == nil {
+		return nil
+	}
+
+	// Apps that didn't log in the interval logged 0 lines. lines is the caller's, so it's copied.
+	observed := make(map[envApp]int, len(lines)+len(d.baselines))
+	for ea, n := range lines {
+		observed[ea] = n
+	}
+	for ea := range d.baselines {
+		if _, ok := observed[ea]; !ok {
+			observed[ea] = 0
+		}
+	}
+
+	result := []volumeSpike{}
+	for ea, n := range observed {
+		b, ok := d.baselines[ea]
+		if !ok {
+			b = &spikeBaseline{lines: float64(n)}
+			d.baselines[ea] = b
+		}
+
+		prev := b.spiking
+		if b.spiking {
+			b.spiking = float64(n) >= d.config.ClearMultiple*b.lines
+		} else {
+			b.spiking = b.intervals >= d.config.Warmup && n >= d.config.MinLines &&
+				float64(n) >= d.config.Multiple*b.lines
+		}
+		if b.spiking || prev {
+			result = append(result, volumeSpike{envApp: ea, lines: n, baseline: b.lines, spiking: b.spiking})
+		}
+		if b.spiking != prev {
+			title := "volume-spike-start"
+			if !b.spiking {
+				title = "volume-spike-end"
+			}
+			lg.WarnD(title, logger.M{"env": ea.env, "application": ea.app, "lines": n, "baseline": b.lines})
+		}
+
+		b.lines = d.config.Alpha*float64(n) + (1-d.config.Alpha)*b.lines
+		b.intervals++
+		// Forget apps that have stopped logging
+		if b.lines < 1 && !b.spiking && n == 0 {
+			delete(d.baselines, ea)
+		}
+	}
+	return result
+}
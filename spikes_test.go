@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Clever/kinesis-alerts-consumer/testharness"
+)
+
+func TestSpikeDetector(t *testing.T) {
+	d := newSpikeDetector(spikeConfig{Alpha: 0.5, Multiple: 4, ClearMultiple: 2, MinLines: 50, Warmup: 2})
+	myApp := envApp{"production", "my-app"}
+	quietApp := envApp{"production", "quiet-app"}
+
+	// Spikes aren't detected while the baseline is learned
+	assert.Empty(t, d.observe(map[envApp]int{myApp: 20, quietApp: 1}))
+	assert.Empty(t, d.observe(map[envApp]int{myApp: 200, quietApp: 1}))
+	assert.Empty(t, d.observe(map[envApp]int{myApp: 20, quietApp: 1}))
+
+	// my-app's baseline is now 65. quiet-app's jump is too few lines to be a spike.
+	assert.Equal(t, []volumeSpike{{envApp: myApp, lines: 300, baseline: 65, spiking: true}},
+		d.observe(map[envApp]int{myApp: 300, quietApp: 40}))
+
+	// The spike continues until volume falls below clear_multiple times the baseline
+	assert.Equal(t, []volumeSpike{{envApp: myApp, lines: 400, baseline: 182.5, spiking: true}},
+		d.observe(map[envApp]int{myApp: 400, quietApp: 1}))
+	lines := map[envApp]int{quietApp: 1}
+	assert.Equal(t, []volumeSpike{{envApp: myApp, lines: 0, baseline: 291.25, spiking: false}},
+		d.observe(lines))
+	// Apps that didn't log aren't added to the caller's lines
+	assert.Equal(t, map[envApp]int{quietApp: 1}, lines)
+	assert.Empty(t, d.observe(map[envApp]int{myApp: 100, quietApp: 1}))
+}
+
+func TestSpikeDetectorForgetsAppsThatStopLogging(t *testing.T) {
+	d := newSpikeDetector(spikeConfig{})
+	d.observe(map[envApp]int{{"production", "my-app"}: 1})
+	assert.Len(t, d.baselines, 1)
+	d.observe(map[envApp]int{})
+	assert.Empty(t, d.baselines)
+}
+
+func TestProcessMetricsShipsVolumeSpikes(t *testing.T) {
+	intake := testharness.NewDatadogIntake()
+	defer intake.Close()
+	dd, err := newDDClient(defaultDDDestination, "test-key", ddSettings{ServerURL: intake.URL})
+	require.NoError(t, err)
+
+	configureSpikes(spikeConfig{Enabled: true, Alpha: 0.5, Multiple: 3, MinLines: 10, Warmup: 2})
+	defer configureSpikes(spikeConfig{})
+	collectMetrics()
+
+	tic := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		processMetrics(dd, tic)
+		close(done)
+	}()
+
+	requests := 0
+	for _, lines := range []int{10, 10, 10, 100} {
+		for i := 0; i < lines; i++ {
+			recordMetrics("production", "my-app", "eng-team", "my-app/-", 10, nil)
+		}
+		tic <- time.Now()
+		requests++
+		require.True(t, intake.WaitForRequests(requests, 5*time.Second))
+	}
+	close(tic)
+	<-done
+
+	spikeValues := []float64{}
+	for _, s := range intake.Series() {
+		if s.Metric == "kinesis_alerts_consumer.volume_spike" {
+			assert.Equal(t, []string{"env:production", "application:my-app", "consumer:" + consumerID}, s.Tags)
+			spikeValues = append(spikeValues, *s.Points[0].Value)
+		}
+	}
+	assert.Equal(t, []float64{1}, spikeValues)
+}
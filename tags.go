@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxDDTagLength is the longest tag Datadog keeps, in characters
+const maxDDTagLength = 200
+
+// normalizeDDTag applies Datadog's tag rules to a "key:value" tag, so that the tag we send is the
+// tag Datadog stores:
+//   - tags are lowercase
+//   - they start with a letter
+//   - other than letters and digits, they only contain _ - : . and /. Other characters become _,
+//     and runs of _ become one.
+//   - they're at most 200 characters, and don't end with _ or :
+//
+// It returns "" if nothing of the tag is left, or nothing of its value, e.g. "env:" or "env:!!",
+// since Datadog would store those as the key-only tag "env".
+func normalizeDDTag(tag string) string {
+	var b strings.Builder
+	b.Grow(len(tag))
+
+	length := 0
+	underscore := false
+	for _, r := range tag {
+		if length >= maxDDTagLength {
+			break
+		}
+		if b.Len() == 0 && !unicode.IsLetter(r) {
+			continue
+		}
+
+		switch {
+		case unicode.IsLetter(r):
+			r = unicode.ToLower(r)
+		case unicode.IsDigit(r), r == '-', r == ':', r == '.', r == '/':
+		default:
+			r = '_'
+		}
+
+		if r == '_' {
+			if underscore {
+				continue
+			}
+			underscore = true
+		} else {
+			underscore = false
+		}
+		b.WriteRune(r)
+		length++
+	}
+
+	normalized := b.String()
+	trimmed := strings.TrimRight(normalized, "_:")
+	if strings.Contains(normalized, ":") && !strings.Contains(trimmed, ":") {
+		return ""
+	}
+	return trimmed
+}
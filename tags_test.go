@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+type tagCase struct {
+	Tag  string `json:"tag"`
+	Want string `json:"want"`
+}
+
+// tagCases are the edge cases of Datadog tag normalization in testdata/dd_tags.golden.json
+var tagCases = []string{
+	"env:production",
+	"Hostname:ip-10-0-1-23",
+	"district:527bac1858c5a34a0c0000d0",
+	"path:/v3.0/students",
+	"version:1.2.3",
+	"url:https://clever.com/oauth?code=abc&state=xyz",
+	"title:Login Start",
+	"names:a,b,c",
+	"message:  leading and trailing spaces  ",
+	"error:failed!!!   badly",
+	"snake__case___key:value",
+	"trailing:underscore_",
+	"empty:",
+	"punctuation:!!!",
+	"colons:a:b:c",
+	"1st_place:gold",
+	"_private:value",
+	"123:456",
+	"école:Élève",
+	"city:Zürich",
+	"emoji:🚀 launch",
+	"cjk:日本語",
+	"tab:a\tb\nc",
+	"key:" + strings.Repeat("a", 250),
+	"key:" + strings.Repeat("b", 194) + "_ccc",
+	"key:" + strings.Repeat("é", 210),
+}
+
+func TestNormalizeDDTagGolden(t *testing.T) {
+	const golden = "testdata/dd_tags.golden.json"
+
+	if *updateGolden {
+		cases := []tagCase{}
+		for _, tag := range tagCases {
+			cases = append(cases, tagCase{Tag: tag, Want: normalizeDDTag(tag)})
+		}
+		b, err := json.MarshalIndent(cases, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(golden, append(b, '\n'), 0644))
+	}
+
+	b, err := ioutil.ReadFile(golden)
+	require.NoError(t, err)
+	cases := []tagCase{}
+	require.NoError(t, json.Unmarshal(b, &cases))
+	require.Len(t, cases, len(tagCases), "run go test -update to regenerate %s", golden)
+
+	for _, c := range cases {
+		got := normalizeDDTag(c.Tag)
+		assert.Equal(t, c.Want, got, c.Tag)
+		// Normalizing is idempotent, and within Datadog's limits
+		assert.Equal(t, got, normalizeDDTag(got), c.Tag)
+		assert.True(t, len([]rune(got)) <= maxDDTagLength, c.Tag)
+	}
+}
+
+func TestEncodeMessageNormalizesTags(t *testing.T) {
+	consumer := AlertsConsumer{}
+	input := map[string]interface{}{
+		"title":     "Login Start",
+		"district":  "ddd",
+		"school":    "",
+		"Hostname":  "my-hostname",
+		"timestamp": time.Unix(0, 0),
+		"_kvmeta": map[string]interface{}{
+			"routes": []interface{}{
+				map[string]interface{}{
+					"type":       "alerts",
+					"series":     "login",
+					"dimensions": []interface{}{"title", "district", "school"},
+					"stat_type":  "counter",
+					"rule":       "login-count",
+				},
+			},
+		},
+	}
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	require.Len(t, eo.DDMetrics, 1)
+	assert.Equal(t, []string{"title:login_start", "district:ddd", "hostname:my-hostname"}, eo.DDMetrics[0].Tags)
+
+	// Lowercasing the Hostname key isn't counted
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("dd_tags_normalized", "route:login-count", "dimension:title")])
+	assert.Equal(t, 0, counters[newCounter("dd_tags_normalized", "route:login-count", "dimension:Hostname")])
+	// An empty value isn't sent as the key-only tag "school"
+	assert.Equal(t, 1, counters[newCounter("dd_tags_normalized", "route:login-count", "dimension:school")])
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	talkersByApp   = "app"
+	talkersByTitle = "title"
+)
+
+// talkersConfig configures the tracking of the apps and log titles with the most volume
+type talkersConfig struct {
+	// Capacity is how many talkers each metrics shard tracks. Talkers outside the top Capacity
+	// are approximated.
+	Capacity int `yaml:"capacity"`
+	// Top is how many talkers are shipped every interval
+	Top int `yaml:"top"`
+	// DebugAddr is the address of the HTTP server with the /debug/top-talkers endpoint of each
+	// process, e.g. ":0" for a free port, which is logged. The server isn't started when it's
+	// empty.
+	DebugAddr string `yaml:"debug_addr"`
+}
+
+func (c talkersConfig) withDefaults() talkersConfig {
+	if c.Capacity == 0 {
+		c.Capacity = 1000
+	}
+	if c.Top == 0 {
+		c.Top = 10
+	}
+	return c
+}
+
+func (c talkersConfig) validate() error {
+	c = c.withDefaults()
+	if c.Capacity < 0 {
+		return fmt.Errorf("invalid top_talkers capacity %d, must be positive", c.Capacity)
+	}
+	if c.Top < 0 {
+		return fmt.Errorf("invalid top_talkers top %d, must be positive", c.Top)
+	}
+	if c.Top > c.Capacity {
+		return fmt.Errorf("top_talkers top %d must not be more than capacity %d", c.Top, c.Capacity)
+	}
+	return nil
+}
+
+var (
+	topTalkersCount = talkersConfig{}.withDefaults().Top
+
+	// previousTalkers are the top talkers of the last interval shipped, by talkersBy*
+	previousTalkers   = map[string][]talker{}
+	previousTalkersMu sync.Mutex
+)
+
+// configureTalkers sets how talkers are tracked. It must be called before processMetrics starts.
+func configureTalkers(config talkersConfig) {
+	config = config.withDefaults()
+	topTalkersCount = config.Top
+	for _, s := range shards {
+		s.mu.Lock()
+		s.appTalkers = newSpaceSaving(config.Capacity)
+		s.titleTalkers = newSpaceSaving(config.Capacity)
+		s.mu.Unlock()
+	}
+}
+
+// shardTalkers returns the talker tables of every metrics shard, by talkersBy*
+func shardTalkers(by string) []*spaceSaving {
+	tables := make([]*spaceSaving, 0, len(shards))
+	for _, s := range shards {
+		s.mu.Lock()
+		if by == talkersByApp {
+			tables = append(tables, s.appTalkers)
+		} else {
+			tables = append(tables, s.titleTalkers)
+		}
+		s.mu.Unlock()
+	}
+	return tables
+}
+
+// talker is a producer of log volume
+type talker struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+	// Error is how much Bytes may overcount, because the talker replaced another one when it
+	// started being tracked
+	Error int64 `json:"error"`
+	// Share is the talker's share of all bytes, from 0 to 1
+	Share float64 `json:"share"`
+
+	index int
+}
+
+// talkerHeap is a min-heap of talkers by Bytes
+type talkerHeap []*talker
+
+func (h talkerHeap) Len() int           { return len(h) }
+func (h talkerHeap) Less(i, j int) bool { return h[i].Bytes < h[j].Bytes }
+func (h talkerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *talkerHeap) Push(x interface{}) {
+	t := x.(*talker)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *talkerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// spaceSaving finds the heavy hitters of a stream with the Space-Saving algorithm: it tracks at
+// most capacity keys, and a new key replaces the smallest one, inheriting its count. Any key with
+// more than total/capacity of the volume is guaranteed to be tracked.
+type spaceSaving struct {
+	mu       sync.Mutex
+	capacity int
+	talkers  map[string]*talker
+	heap     talkerHeap
+	total    int64
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		talkers:  map[string]*talker{},
+	}
+}
+
+// add counts n bytes for key
+func (s *spaceSaving) add(key string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total += n
+	if t, ok := s.talkers[key]; ok {
+		t.Bytes += n
+		heap.Fix(&s.heap, t.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		t := &talker{Key: key, Bytes: n}
+		s.talkers[key] = t
+		heap.Push(&s.heap, t)
+		return
+	}
+
+	smallest := s.heap[0]
+	delete(s.talkers, smallest.Key)
+	smallest.Key = key
+	smallest.Error = smallest.Bytes
+	smallest.Bytes += n
+	s.talkers[key] = smallest
+	heap.Fix(&s.heap, 0)
+}
+
+// top returns the n talkers with the most bytes, largest first
+func (s *spaceSaving) top(n int) []talker {
+	return mergeTalkers([]*spaceSaving{s}, n, false)
+}
+
+// flush returns the n talkers with the most bytes, and starts a new interval
+func (s *spaceSaving) flush(n int) []talker {
+	return mergeTalkers([]*spaceSaving{s}, n, true)
+}
+
+// snapshot returns every tracked talker and the total bytes, and starts a new interval if reset
+func (s *spaceSaving) snapshot(reset bool) ([]talker, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	talkers := make([]talker, 0, len(s.heap))
+	for _, t := range s.heap {
+		talkers = append(talkers, *t)
+	}
+	total := s.total
+	if reset {
+		s.talkers = map[string]*talker{}
+		s.heap = nil
+		s.total = 0
+	}
+	return talkers, total
+}
+
+// mergeTalkers returns the n talkers with the most bytes over several tables, largest first. The
+// bytes and errors of a talker tracked by several tables add up. It starts a new interval in
+// every table if reset.
+func mergeTalkers(tables []*spaceSaving, n int, reset bool) []talker {
+	merged := map[string]*talker{}
+	var total int64
+	for _, table := range tables {
+		talkers, tableTotal := table.snapshot(reset)
+		total += tableTotal
+		for _, t := range talkers {
+			if m, ok := merged[t.Key]; ok {
+				m.Bytes += t.Bytes
+				m.Error += t.Error
+				continue
+			}
+			c := t
+			c.index = 0
+			merged[t.Key] = &c
+		}
+	}
+
+	talkers := make([]talker, 0, len(merged))
+	for _, t := range merged {
+		c := *t
+		if total > 0 {
+			c.Share = float64(c.Bytes) / float64(total)
+		}
+		talkers = append(talkers, c)
+	}
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].Bytes == talkers[j].Bytes {
+			return talkers[i].Key < talkers[j].Key
+		}
+		return talkers[i].Bytes > talkers[j].Bytes
+	})
+	if len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers
+}
+
+// flushTalkers returns the top talkers of the interval by talkersBy*, merged over the metrics
+// shards, and starts a new interval
+func flushTalkers() map[string][]talker {
+	top := map[string][]talker{
+		talkersByApp:   mergeTalkers(shardTalkers(talkersByApp), topTalkersCount, true),
+		talkersByTitle: mergeTalkers(shardTalkers(talkersByTitle), topTalkersCount, true),
+	}
+	previousTalkersMu.Lock()
+	previousTalkers = top
+	previousTalkersMu.Unlock()
+	return top
+}
+
+// topTalkersHandler serves the top talkers of the current interval, and of the last one shipped
+func topTalkersHandler(w http.ResponseWriter, r *http.Request) {
+	previousTalkersMu.Lock()
+	previous := previousTalkers
+	previousTalkersMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current": map[string][]talker{
+			talkersByApp:   mergeTalkers(shardTalkers(talkersByApp), topTalkersCount, false),
+			talkersByTitle: mergeTalkers(shardTalkers(talkersByTitle), topTalkersCount, false),
+		},
+		"previous": previous,
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceSavingIsExactUnderCapacity(t *testing.T) {
+	s := newSpaceSaving(10)
+	s.add("production/my-app", 300)
+	s.add("production/other-app", 100)
+	s.add("production/my-app", 100)
+
+	assert.Equal(t, []talker{
+		{Key: "production/my-app", Bytes: 400, Share: 0.8},
+		{Key: "production/other-app", Bytes: 100, Share: 0.2},
+	}, stripIndex(s.top(10)))
+	assert.Len(t, s.top(1), 1)
+}
+
+func TestSpaceSavingFindsHeavyHitters(t *testing.T) {
+	s := newSpaceSaving(5)
+	for i := 0; i < 1000; i++ {
+		s.add(fmt.Sprintf("app-%d", i), 10)
+		if i%4 == 0 {
+			s.add("flood", 100)
+		}
+	}
+
+	top := s.top(3)
+	require.Len(t, top, 3)
+	assert.Equal(t, "flood", top[0].Key)
+	// The flood's count is overestimated by at most its error
+	assert.True(t, top[0].Bytes-top[0].Error <= 25000)
+	assert.True(t, top[0].Bytes >= 25000)
+	assert.InDelta(t, float64(top[0].Bytes)/35000, top[0].Share, 0.0001)
+}
+
+func TestSpaceSavingFlush(t *testing.T) {
+	s := newSpaceSaving(5)
+	s.add("a", 1)
+	assert.Len(t, s.flush(10), 1)
+	assert.Empty(t, s.top(10))
+
+	s.add("b", 2)
+	assert.Equal(t, []talker{{Key: "b", Bytes: 2, Share: 1}}, stripIndex(s.top(10)))
+}
+
+func TestTopTalkersHandler(t *testing.T) {
+	configureTalkers(talkersConfig{Top: 2})
+	shards[0].appTalkers.add("production/my-app", 30)
+	shards[0].titleTalkers.add("oauth/login_start", 30)
+	flushTalkers()
+	shards[1].appTalkers.add("production/other-app", 10)
+
+	rec := httptest.NewRecorder()
+	topTalkersHandler(rec, httptest.NewRequest("GET", "/debug/top-talkers", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	body := map[string]map[string][]talker{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, []talker{{Key: "production/other-app", Bytes: 10, Share: 1}}, body["current"][talkersByApp])
+	assert.Empty(t, body["current"][talkersByTitle])
+	assert.Equal(t, []talker{{Key: "production/my-app", Bytes: 30, Share: 1}}, body["previous"][talkersByApp])
+	assert.Equal(t, []talker{{Key: "oauth/login_start", Bytes: 30, Share: 1}}, body["previous"][talkersByTitle])
+
+	configureTalkers(talkersConfig{})
+}
+
+func TestFlushTalkersMergesShards(t *testing.T) {
+	configureTalkers(talkersConfig{Top: 2})
+	defer configureTalkers(talkersConfig{})
+	recordMetrics("production", "my-app", "eng-team", "oauth/login_start", 30, nil)
+	shards[0].appTalkers.add("production/my-app", 10)
+	shards[1].appTalkers.add("production/my-app", 20)
+	shards[1].appTalkers.add("production/other-app", 40)
+	shards[2].appTalkers.add("production/small-app", 5)
+	collectMetrics()
+
+	top := flushTalkers()
+	assert.Equal(t, []talker{
+		{Key: "production/my-app", Bytes: 60, Share: 60.0 / 105},
+		{Key: "production/other-app", Bytes: 40, Share: 40.0 / 105},
+	}, stripIndex(top[talkersByApp]))
+	assert.Equal(t, []talker{{Key: "oauth/login_start", Bytes: 30, Share: 1}}, stripIndex(top[talkersByTitle]))
+	assert.Empty(t, flushTalkers()[talkersByApp])
+}
+
+// stripIndex clears the heap indexes of talkers, so they can be compared
+func stripIndex(talkers []talker) []talker {
+	for i := range talkers {
+		talkers[i].index = 0
+	}
+	return talkers
+}
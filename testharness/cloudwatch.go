@@ -0,0 +1,207 @@
+package testharness
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// PutMetricDataRequest is a request received by the fake CloudWatch API
+type PutMetricDataRequest struct {
+	// Region is read from the request's signature
+	Region     string
+	Namespace  string
+	MetricData []*cloudwatch.MetricDatum
+}
+
+// CloudWatch is a fake of the CloudWatch query API that only supports PutMetricData. It serves
+// every region; use Client to get a client for one of them.
+type CloudWatch struct {
+	*server
+	received []PutMetricDataRequest
+}
+
+// NewCloudWatch starts a fake CloudWatch API. Close it when done.
+func NewCloudWatch() *CloudWatch {
+	c := &CloudWatch{}
+	c.server = newServer(c.handle)
+	return c
+}
+
+// Client returns a CloudWatch client for region that talks to the fake
+func (c *CloudWatch) Client(region string) cloudwatchiface.CloudWatchAPI {
+	return cloudwatch.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Endpoint:    aws.String(c.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+}
+
+var reCredentialScope = regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/`)
+
+func (c *CloudWatch) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeCWError(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+		return
+	}
+	if action := r.PostForm.Get("Action"); action != "PutMetricData" {
+		writeCWError(w, http.StatusBadRequest, "InvalidAction", "unsupported action "+action)
+		return
+	}
+
+	req := PutMetricDataRequest{Namespace: r.PostForm.Get("Namespace")}
+	if m := reCredentialScope.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		req.Region = m[1]
+	}
+	data, err := parseMetricData(r.PostForm)
+	if err != nil {
+		writeCWError(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	req.MetricData = data
+
+	c.mu.Lock()
+	c.received = append(c.received, req)
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, `<PutMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/">`+
+		`<ResponseMetadata><RequestId>fake-request-id</RequestId></ResponseMetadata></PutMetricDataResponse>`)
+}
+
+// Received returns the requests accepted by the fake
+func (c *CloudWatch) Received() []PutMetricDataRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]PutMetricDataRequest{}, c.received...)
+}
+
+// CloudWatchFault returns a fault shaped like an error response of the CloudWatch API
+func CloudWatchFault(status int, code, message string) Fault {
+	return Fault{
+		Status: status,
+		Header: http.Header{"Content-Type": []string{"text/xml"}},
+		Body:   cwErrorBody(status, code, message),
+	}
+}
+
+func writeCWError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	fmt.Fprint(w, cwErrorBody(status, code, message))
+}
+
+func cwErrorBody(status int, code, message string) string {
+	errType := "Sender"
+	if status >= 500 {
+		errType = "Receiver"
+	}
+	return fmt.Sprintf(`<ErrorResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/">`+
+		`<Error><Type>%s</Type><Code>%s</Code><Message>%s</Message></Error>`+
+		`<RequestId>fake-request-id</RequestId></ErrorResponse>`, errType, code, message)
+}
+
+// parseMetricData decodes the MetricData.member.N.* parameters of a PutMetricData request
+func parseMetricData(form map[string][]string) ([]*cloudwatch.MetricDatum, error) {
+	byIndex := map[int]*cloudwatch.MetricDatum{}
+	dimsByIndex := map[int]map[int]*cloudwatch.Dimension{}
+
+	for key, values := range form {
+		if !strings.HasPrefix(key, "MetricData.member.") || len(values) == 0 {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(key, "MetricData.member."), ".")
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) < 2 {
+			return nil, fmt.Errorf("invalid parameter %s", key)
+		}
+		dat, ok := byIndex[idx]
+		if !ok {
+			dat = &cloudwatch.MetricDatum{}
+			byIndex[idx] = dat
+		}
+
+		val := values[0]
+		switch parts[1] {
+		case "MetricName":
+			dat.MetricName = aws.String(val)
+		case "Unit":
+			dat.Unit = aws.String(val)
+		case "Value":
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %s", key, val)
+			}
+			dat.Value = aws.Float64(f)
+		case "StorageResolution":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %s", key, val)
+			}
+			dat.StorageResolution = aws.Int64(n)
+		case "Timestamp":
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %s", key, val)
+			}
+			dat.Timestamp = aws.Time(ts)
+		case "Dimensions":
+			// Dimensions.member.M.Name / Dimensions.member.M.Value
+			if len(parts) != 5 {
+				return nil, fmt.Errorf("invalid parameter %s", key)
+			}
+			dimIdx, err := strconv.Atoi(parts[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter %s", key)
+			}
+			if dimsByIndex[idx] == nil {
+				dimsByIndex[idx] = map[int]*cloudwatch.Dimension{}
+			}
+			dim, ok := dimsByIndex[idx][dimIdx]
+			if !ok {
+				dim = &cloudwatch.Dimension{}
+				dimsByIndex[idx][dimIdx] = dim
+			}
+			if parts[4] == "Name" {
+				dim.Name = aws.String(val)
+			} else {
+				dim.Value = aws.String(val)
+			}
+		}
+	}
+
+	data := make([]*cloudwatch.MetricDatum, 0, len(byIndex))
+	for _, idx := range sortedKeys(byIndex) {
+		dat := byIndex[idx]
+		dims := dimsByIndex[idx]
+		dat.Dimensions = []*cloudwatch.Dimension{}
+		for _, dimIdx := range sortedKeys(dims) {
+			dat.Dimensions = append(dat.Dimensions, dims[dimIdx])
+		}
+		if dat.MetricName == nil {
+			return nil, fmt.Errorf("MetricData.member.%d.MetricName is required", idx)
+		}
+		data = append(data, dat)
+	}
+	return data, nil
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
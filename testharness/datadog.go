@@ -0,0 +1,113 @@
+package testharness
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	datadog "github.com/DataDog/datadog-api-client-go/api/v2/datadog"
+)
+
+// SeriesRequest is a request received by the fake Datadog intake
+type SeriesRequest struct {
+	APIKey          string
+	ContentEncoding string
+	Payload         datadog.MetricPayload
+}
+
+// DatadogIntake is a fake of the Datadog v2 series endpoint (POST /api/v2/series). Point a
+// client at it with the server_url setting.
+type DatadogIntake struct {
+	*server
+	received []SeriesRequest
+}
+
+// NewDatadogIntake starts a fake Datadog intake. Close it when done.
+func NewDatadogIntake() *DatadogIntake {
+	d := &DatadogIntake{}
+	d.server = newServer(d.handle)
+	return d
+}
+
+func (d *DatadogIntake) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v2/series" {
+		writeDDError(w, http.StatusNotFound, fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if r.Header.Get("DD-API-KEY") == "" {
+		writeDDError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			writeDDError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		body = zr
+	case "gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeDDError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		body = gr
+	}
+
+	payload := datadog.MetricPayload{}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		writeDDError(w, http.StatusBadRequest, "Payload is not in the expected format: "+err.Error())
+		return
+	}
+
+	d.mu.Lock()
+	d.received = append(d.received, SeriesRequest{
+		APIKey:          r.Header.Get("DD-API-KEY"),
+		ContentEncoding: r.Header.Get("Content-Encoding"),
+		Payload:         payload,
+	})
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"errors": []}`))
+}
+
+// Received returns the requests accepted by the intake
+func (d *DatadogIntake) Received() []SeriesRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]SeriesRequest{}, d.received...)
+}
+
+// Series returns every series accepted by the intake, across requests
+func (d *DatadogIntake) Series() []datadog.MetricSeries {
+	series := []datadog.MetricSeries{}
+	for _, req := range d.Received() {
+		series = append(series, req.Payload.Series...)
+	}
+	return series
+}
+
+// DatadogFault returns a fault shaped like an error response of the Datadog API
+func DatadogFault(status int, errors ...string) Fault {
+	b, _ := json.Marshal(map[string][]string{"errors": errors})
+	return Fault{
+		Status: status,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   string(b),
+	}
+}
+
+func writeDDError(w http.ResponseWriter, status int, msg string) {
+	f := DatadogFault(status, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.Status)
+	w.Write([]byte(f.Body))
+}
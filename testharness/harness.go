@@ -0,0 +1,105 @@
+// Package testharness provides local fakes of the sinks used by the consumer, so that tests can
+// check what is actually sent over the wire. Each fake records the requests it receives, and can
+// be told to fail or slow down requests.
+package testharness
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Fault is a canned response returned instead of handling a request
+type Fault struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// server holds the fault injection and bookkeeping shared by the fakes
+type server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	faults   []Fault
+	latency  time.Duration
+	requests int
+	received chan struct{}
+}
+
+func newServer(handle func(w http.ResponseWriter, r *http.Request)) *server {
+	s := &server{received: make(chan struct{}, 1)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, handle)
+	}))
+	return s
+}
+
+func (s *server) serve(w http.ResponseWriter, r *http.Request, handle func(w http.ResponseWriter, r *http.Request)) {
+	s.mu.Lock()
+	latency := s.latency
+	var fault *Fault
+	if len(s.faults) > 0 {
+		fault = &s.faults[0]
+		s.faults = s.faults[1:]
+	}
+	s.mu.Unlock()
+
+	time.Sleep(latency)
+
+	if fault != nil {
+		for k, vs := range fault.Header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(fault.Status)
+		w.Write([]byte(fault.Body))
+	} else {
+		handle(w, r)
+	}
+
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+}
+
+// FailNext makes the next requests fail with faults, one request per fault
+func (s *server) FailNext(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, faults...)
+}
+
+// SetLatency delays every response by d
+func (s *server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Requests returns the number of requests served, including failed ones
+func (s *server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// WaitForRequests blocks until at least n requests have been served, or timeout passes. It
+// returns whether n requests were served.
+func (s *server) WaitForRequests(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for s.Requests() < n {
+		select {
+		case <-s.received:
+		case <-deadline:
+			return s.Requests() >= n
+		}
+	}
+	return true
+}
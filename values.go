@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+)
+
+// durationUnits are the units duration strings can be converted to
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// valueCoercionConfig makes the value field of an alert rule, or of every rule of a series,
+// lenient about the types it accepts. Without it, values have to be numbers.
+type valueCoercionConfig struct {
+	// Exactly one of Rule and Series is set. Rule coercions take precedence over series ones.
+	Rule   string `yaml:"rule"`
+	Series string `yaml:"series"`
+	// NumericStrings accepts numbers in strings, e.g. "42" or "12.5"
+	NumericStrings bool `yaml:"numeric_strings"`
+	// DurationUnit accepts durations in strings, e.g. "12.5ms" or "1m30s", converted to the unit
+	// (ns, us, ms, s, m or h)
+	DurationUnit string `yaml:"duration_unit"`
+	// Bools accepts true as 1 and false as 0
+	Bools bool `yaml:"bools"`
+}
+
+// name identifies the coercion in errors, e.g. "rule/api-latency"
+func (c valueCoercionConfig) name() string {
+	if c.Rule != "" {
+		return "rule/" + c.Rule
+	}
+	return "series/" + c.Series
+}
+
+func (c valueCoercionConfig) validate() error {
+	if (c.Rule == "") == (c.Series == "") {
+		return fmt.Errorf("value coercion must have exactly one of rule and series")
+	}
+	if _, ok := durationUnits[c.DurationUnit]; c.DurationUnit != "" && !ok {
+		return fmt.Errorf("value coercion %s has invalid duration_unit %s, must be ns, us, ms, s, m or h", c.name(), c.DurationUnit)
+	}
+	if !c.NumericStrings && c.DurationUnit == "" && !c.Bools {
+		return fmt.Errorf("value coercion %s must coerce numeric_strings, durations or bools", c.name())
+	}
+	return nil
+}
+
+// valueCoercer converts the values of routes to numbers.
+//
+// A nil *valueCoercer only accepts numbers.
+type valueCoercer struct {
+	byRule   map[string]valueCoercionConfig
+	bySeries map[string]valueCoercionConfig
+}
+
+func newValueCoercer(configs []valueCoercionConfig) *valueCoercer {
+	v := &valueCoercer{
+		byRule:   map[string]valueCoercionConfig{},
+		bySeries: map[string]valueCoercionConfig{},
+	}
+	for _, config := range configs {
+		if config.Rule != "" {
+			v.byRule[config.Rule] = config
+		} else {
+			v.bySeries[config.Series] = config
+		}
+	}
+	return v
+}
+
+// coerce returns the number of a route's value, and false if it can't be converted
+func (v *valueCoercer) coerce(route decode.AlertRoute, val interface{}) (float64, bool) {
+	switch t := val.(type) {
+	case float64:
+		return t, true
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	}
+	if v == nil {
+		return 0, false
+	}
+	config, ok := v.byRule[route.RuleName]
+	if !ok {
+		config, ok = v.bySeries[route.Series]
+	}
+	if !ok {
+		return 0, false
+	}
+
+	switch t := val.(type) {
+	case bool:
+		if !config.Bools {
+			return 0, false
+		}
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		s := strings.TrimSpace(t)
+		if config.NumericStrings {
+			if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				return f, true
+			}
+		}
+		if config.DurationUnit != "" {
+			if d, err := time.ParseDuration(s); err == nil {
+				return float64(d) / float64(durationUnits[config.DurationUnit]), true
+			}
+		}
+	}
+	return 0, false
+}
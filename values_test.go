@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Clever/amazon-kinesis-client-go/decode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueCoercer(t *testing.T) {
+	coercer := newValueCoercer([]valueCoercionConfig{
+		{Rule: "lenient-rule", NumericStrings: true, DurationUnit: "ms", Bools: true},
+		{Series: "durations", DurationUnit: "s"},
+	})
+	lenient := decode.AlertRoute{RuleName: "lenient-rule", Series: "any"}
+	durations := decode.AlertRoute{RuleName: "other-rule", Series: "durations"}
+	strict := decode.AlertRoute{RuleName: "strict-rule", Series: "strict"}
+
+	tests := []struct {
+		name  string
+		route decode.AlertRoute
+		val   interface{}
+		want  float64
+		ok    bool
+	}{
+		{name: "float", route: strict, val: 12.5, want: 12.5, ok: true},
+		{name: "int", route: strict, val: 12, want: 12, ok: true},
+		{name: "int64", route: strict, val: int64(12), want: 12, ok: true},
+		{name: "strict string", route: strict, val: "42"},
+		{name: "strict bool", route: strict, val: true},
+		{name: "numeric string", route: lenient, val: " 42 ", want: 42, ok: true},
+		{name: "float string", route: lenient, val: "12.5", want: 12.5, ok: true},
+		{name: "NaN string", route: lenient, val: "NaN"},
+		{name: "duration string", route: lenient, val: "1.5s", want: 1500, ok: true},
+		{name: "duration in seconds", route: durations, val: "1m30s", want: 90, ok: true},
+		{name: "numeric string without numeric_strings", route: durations, val: "42"},
+		{name: "true", route: lenient, val: true, want: 1, ok: true},
+		{name: "false", route: lenient, val: false, want: 0, ok: true},
+		{name: "bool without bools", route: durations, val: true},
+		{name: "not a number", route: lenient, val: "abc"},
+		{name: "object", route: lenient, val: map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			val, ok := coercer.coerce(tt.route, tt.val)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, val)
+		})
+	}
+
+	var none *valueCoercer
+	val, ok := none.coerce(lenient, 12.5)
+	assert.True(t, ok)
+	assert.Equal(t, 12.5, val)
+	_, ok = none.coerce(lenient, "42")
+	assert.False(t, ok)
+}
+
+func TestValueCoercionConfigValidate(t *testing.T) {
+	testValidate(t, []validateCase{
+		{
+			name:   "rule",
+			config: valueCoercionConfig{Rule: "api-latency", NumericStrings: true, DurationUnit: "ms"},
+		},
+		{
+			name:   "series",
+			config: valueCoercionConfig{Series: "feature-enabled", Bools: true},
+		},
+		{
+			name:    "rule and series",
+			config:  valueCoercionConfig{Rule: "api-latency", Series: "latency", Bools: true},
+			wantErr: "exactly one of rule and series",
+		},
+		{
+			name:    "invalid unit",
+			config:  valueCoercionConfig{Rule: "api-latency", DurationUnit: "days"},
+			wantErr: "invalid duration_unit days",
+		},
+		{
+			name:    "nothing coerced",
+			config:  valueCoercionConfig{Rule: "api-latency"},
+			wantErr: "must coerce numeric_strings, durations or bools",
+		},
+	})
+}
+
+func TestEncodeMessageCoercesValues(t *testing.T) {
+	consumer := AlertsConsumer{}
+	consumer.enableValueCoercion([]valueCoercionConfig{
+		{Rule: "latency-rule", DurationUnit: "ms"},
+	})
+
+	input := map[string]interface{}{
+		"latency":   "1.5s",
+		"count":     "3",
+		"Hostname":  "my-hostname",
+		"timestamp": time.Unix(0, 0),
+		"_kvmeta": map[string]interface{}{
+			"team": "eng-team",
+			"routes": []interface{}{
+				map[string]interface{}{
+					"type":        "alerts",
+					"series":      "latency",
+					"dimensions":  []interface{}{},
+					"stat_type":   "gauge",
+					"value_field": "latency",
+					"rule":        "latency-rule",
+				},
+				map[string]interface{}{
+					"type":        "alerts",
+					"series":      "count",
+					"dimensions":  []interface{}{},
+					"stat_type":   "counter",
+					"value_field": "count",
+					"rule":        "count-rule",
+				},
+			},
+		},
+	}
+
+	collectMetrics()
+	output, _, err := consumer.encodeMessage(input, 0)
+	require.NoError(t, err)
+	eo := EncodeOutput{}
+	require.NoError(t, json.Unmarshal(output, &eo))
+	// The route with a bad value is skipped, but doesn't fail the others
+	require.Len(t, eo.DDMetrics, 1)
+	assert.Equal(t, "kv.latency", eo.DDMetrics[0].Metric)
+	assert.Equal(t, 1500.0, *eo.DDMetrics[0].Points[0].Value)
+
+	counters := collectMetrics().counters
+	assert.Equal(t, 1, counters[newCounter("route_errors", "route:count-rule", "reason:value_type", "team:eng-team")])
+}